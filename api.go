@@ -0,0 +1,472 @@
+package godm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix of every JSON API route, bumped when the API changes incompatibly
+const apiPrefix = "/api/v1/"
+
+// apiJob is a job as returned by the API
+type apiJob struct {
+	Job
+	Progress float64 `json:"progress"`
+}
+
+func newApiJob(j Job) apiJob {
+	return apiJob{Job: j, Progress: j.Progress()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing JSON:", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Println(r.RemoteAddr, r.RequestURI, status, err)
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+/*
+Route the JSON API:
+
+	GET    /api/v1/jobs             list the jobs
+	POST   /api/v1/jobs             submit an ODM, as multipart odmFile or the raw body
+	GET    /api/v1/jobs/<id>        job detail with the progress of each part
+	GET    /api/v1/jobs/<id>/events stream the log and progress of the job as server-sent events
+	GET    /api/v1/jobs/<id>/cover  the cover of the book
+	DELETE /api/v1/jobs/<id>        forget a finished job
+	POST   /api/v1/jobs/<id>/cancel stop a queued or running job
+	POST   /api/v1/jobs/<id>/retry  queue a finished job again
+	POST   /api/v1/jobs/<id>/return return the book now
+	POST   /api/v1/uploads          submit many ODMs as multipart odmFile, with a result for each
+	GET    /api/v1/library          list the downloaded books
+	GET    /api/v1/library/book     ?id= book detail with its chapters and playback position
+	GET    /api/v1/library/cover    ?id= the cover of the book
+	GET    /api/v1/library/stream   ?id=&file= a chapter, with range requests for seeking
+	GET    /api/v1/library/position ?id= where the user is in the book
+	PUT    /api/v1/library/position ?id= remember where the user is, as {"file": ..., "time": ...}
+*/
+func (s *Server) api(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "jobs":
+		switch r.Method {
+		case "GET":
+			s.apiListJobs(w, r)
+		case "POST":
+			s.apiSubmit(w, r)
+		default:
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		}
+	case len(path) == 2 && path[0] == "jobs":
+		switch r.Method {
+		case "GET":
+			s.apiGetJob(w, r, path[1])
+		case "DELETE":
+			s.apiJobAction(w, r, path[1], s.jobs.Delete)
+		default:
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		}
+	case len(path) == 3 && path[0] == "jobs" && r.Method == "GET":
+		switch path[2] {
+		case "events":
+			s.apiEvents(w, r, path[1])
+		case "cover":
+			s.apiCover(w, r, path[1])
+		default:
+			apiError(w, r, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+	case len(path) == 3 && path[0] == "jobs":
+		if r.Method != "POST" {
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		actions := map[string]func(string) error{
+			"cancel": s.jobs.Cancel,
+			"retry":  s.jobs.Retry,
+			"return": s.returnJob,
+		}
+		action, ok := actions[path[2]]
+		if !ok {
+			apiError(w, r, http.StatusNotFound, fmt.Errorf("unknown action %q", path[2]))
+			return
+		}
+		s.apiJobAction(w, r, path[1], action)
+	case len(path) == 1 && path[0] == "uploads":
+		if r.Method != "POST" {
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		results, err := s.addUploads(w, r)
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	case len(path) == 1 && path[0] == "library":
+		if r.Method != "GET" {
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		s.apiLibrary(w, r)
+	case len(path) == 2 && path[0] == "library":
+		handlers := map[string]http.HandlerFunc{
+			"book":     s.apiLibraryBook,
+			"cover":    s.apiLibraryCover,
+			"stream":   s.apiStream,
+			"position": s.apiPosition,
+		}
+		handler, ok := handlers[path[1]]
+		switch {
+		case !ok:
+			apiError(w, r, http.StatusNotFound, fmt.Errorf("not found"))
+		case r.Method != "GET" && !(path[1] == "position" && r.Method == "PUT"):
+			apiError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		default:
+			handler(w, r)
+		}
+	default:
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (s *Server) apiListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := make([]apiJob, 0)
+	u := requestUser(r)
+	for _, j := range s.jobs.List() {
+		if !u.CanSee(j) {
+			continue
+		}
+		// The list stays small, the parts are only in the job detail
+		j.Parts = nil
+		jobs = append(jobs, newApiJob(j))
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// Get the job if the user of the request may see it
+func (s *Server) visibleJob(r *http.Request, id string) (Job, bool) {
+	j, ok := s.jobs.Get(id)
+	if !ok || !requestUser(r).CanSee(j) {
+		return Job{}, false
+	}
+	return j, true
+}
+
+func (s *Server) apiGetJob(w http.ResponseWriter, r *http.Request, id string) {
+	j, ok := s.visibleJob(r, id)
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNoJob)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApiJob(j))
+}
+
+/*
+Submit an ODM. A multipart form uses the odmFile field, anything else is the ODM itself with
+the filename from ?name=, the Content-Disposition header, or the ODM id. If the book was
+submitted before ?duplicate= can be resume, redownload or link
+*/
+func (s *Server) apiSubmit(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader
+	name := r.URL.Query().Get("name")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		// Room for one ODM and the multipart headers around it
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize+1024)
+		file, header, err := r.FormFile("odmFile")
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		defer file.Close()
+		body, name = file, header.Filename
+	} else {
+		body = r.Body
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && name == "" {
+			name = params["filename"]
+		}
+	}
+	if name == "" {
+		data, err := ioutil.ReadAll(io.LimitReader(body, s.maxUploadSize+1))
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		odm := &OverDriveMedia{}
+		if err := xml.Unmarshal(data, odm); err != nil || odm.Id == "" {
+			apiError(w, r, http.StatusNotAcceptable, fmt.Errorf("invalid ODM file"))
+			return
+		}
+		body, name = bytes.NewReader(data), odm.Id+".odm"
+	}
+
+	job, err := s.addODM(name, body, requestUser(r), r.URL.Query().Get("duplicate"))
+	switch {
+	case err == ErrDuplicateJob:
+		writeJSON(w, http.StatusConflict, newApiJob(job))
+	case err == ErrInLibrary:
+		apiError(w, r, http.StatusConflict, err)
+	case err != nil:
+		apiError(w, r, http.StatusNotAcceptable, err)
+	default:
+		writeJSON(w, http.StatusCreated, newApiJob(job))
+	}
+}
+
+// Run an action on a job and reply with the job as it is afterwards
+func (s *Server) apiJobAction(w http.ResponseWriter, r *http.Request, id string, action func(string) error) {
+	if _, ok := s.visibleJob(r, id); !ok {
+		apiError(w, r, http.StatusNotFound, ErrNoJob)
+		return
+	}
+	if err := action(id); err != nil {
+		apiError(w, r, http.StatusConflict, err)
+		return
+	}
+	j, ok := s.jobs.Get(id)
+	if !ok {
+		// Deleted
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApiJob(j))
+}
+
+// The library the user of the request sees
+func (s *Server) libraryRoot(r *http.Request) string {
+	// Admins see the whole library, with the books of each user under their name
+	if u := requestUser(r); u != nil && !u.Admin {
+		return s.userOutdir(u.Name)
+	}
+	return s.Outdir
+}
+
+func (s *Server) apiLibrary(w http.ResponseWriter, r *http.Request) {
+	books, err := ScanLibrary(s.libraryRoot(r))
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// The list stays small, the chapters are only in the book detail
+	for i := range books {
+		books[i].Chapters = nil
+	}
+	writeJSON(w, http.StatusOK, books)
+}
+
+// The book of ?id= in the library of the user
+func (s *Server) requestBook(w http.ResponseWriter, r *http.Request) (LibraryBook, bool) {
+	b, err := ReadLibraryBook(s.libraryRoot(r), r.URL.Query().Get("id"))
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, err)
+		return LibraryBook{}, false
+	}
+	return b, true
+}
+
+func (s *Server) apiLibraryBook(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.requestBook(w, r)
+	if !ok {
+		return
+	}
+	book := struct {
+		LibraryBook
+		Position *Position `json:"position,omitempty"`
+	}{LibraryBook: b}
+	pos, played, err := s.positions.Get(requestUser(r).owner(), b.Id)
+	if err != nil {
+		log.Println("Could not read playback positions:", err)
+	}
+	if played {
+		book.Position = &pos
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+func (s *Server) apiLibraryCover(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.requestBook(w, r)
+	if !ok {
+		return
+	}
+	if !b.Cover {
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("no cover"))
+		return
+	}
+	root := s.libraryRoot(r)
+	dir, _ := LibraryBookDir(root, b.Id)
+	cover := filepath.Join(dir, "folder.jpg")
+	if !insideDir(root, cover) {
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("no cover"))
+		return
+	}
+	http.ServeFile(w, r, cover)
+}
+
+// Stream a chapter, ServeContent handles the range requests browsers make to seek
+func (s *Server) apiStream(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.requestBook(w, r)
+	if !ok {
+		return
+	}
+	file := r.URL.Query().Get("file")
+	f, err := OpenChapter(s.libraryRoot(r), b, file)
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("no chapter %q", file))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", audioTypes[strings.ToLower(filepath.Ext(file))])
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+func (s *Server) apiPosition(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.requestBook(w, r)
+	if !ok {
+		return
+	}
+	user := requestUser(r).owner()
+	if r.Method == "PUT" {
+		var pos Position
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&pos); err != nil {
+			apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		chapter := false
+		for _, c := range b.Chapters {
+			chapter = chapter || c.File == pos.File
+		}
+		if !chapter || pos.Time < 0 {
+			apiError(w, r, http.StatusBadRequest, fmt.Errorf("no chapter %q at %v", pos.File, pos.Time))
+			return
+		}
+		if err := s.positions.Set(user, b.Id, pos); err != nil {
+			apiError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	pos, played, err := s.positions.Get(user, b.Id)
+	switch {
+	case err != nil:
+		apiError(w, r, http.StatusInternalServerError, err)
+	case !played:
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("not played yet"))
+	default:
+		writeJSON(w, http.StatusOK, pos)
+	}
+}
+
+/*
+Stream the events of a job as server-sent events. The job and its log so far are sent first,
+then every change until the job finishes, with the progress of the parts every second
+*/
+func (s *Server) apiEvents(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok := s.visibleJob(r, id)
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNoJob)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, r, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events, cancel := s.events.Subscribe(id)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding the events back
+	w.WriteHeader(http.StatusOK)
+
+	if b, err := ioutil.ReadFile(s.jobs.LogFile(job)); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			if line != "" {
+				writeEvent(w, logEvent(id, line))
+			}
+		}
+	}
+	writeEvent(w, jobEvent(EventJob, job))
+	flusher.Flush()
+	if job.Final() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			writeEvent(w, e)
+			flusher.Flush()
+			if e.Type == EventJob && e.Job.Final() {
+				return
+			}
+		case <-ticker.C:
+			if job, ok := s.jobs.Get(id); ok && job.State == JobDownloading {
+				writeEvent(w, jobEvent(EventProgress, job))
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w io.Writer, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Error writing event:", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+}
+
+// Serve the saved cover of the book, or send the browser to the thumbnail from the ODM
+func (s *Server) apiCover(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok := s.visibleJob(r, id)
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNoJob)
+		return
+	}
+	if job.Outdir != "" {
+		if f, err := os.Open(filepath.Join(job.Outdir, "folder.jpg")); err == nil {
+			defer f.Close()
+			if info, err := f.Stat(); err == nil {
+				http.ServeContent(w, r, "folder.jpg", info.ModTime(), f)
+				return
+			}
+		}
+	}
+	o, err := NewODMFile(job.Odm)
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, err)
+		return
+	}
+	md, err := o.GetMetadata()
+	if err != nil || md.ThumbnailUrl == "" {
+		apiError(w, r, http.StatusNotFound, fmt.Errorf("no cover"))
+		return
+	}
+	http.Redirect(w, r, md.ThumbnailUrl, http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,141 @@
+package godm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User names become directory names, so only allow safe ones
+var USER_RE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// User is someone logged in to the server
+type User struct {
+	Name     string
+	Admin    bool   // Admins see the jobs and books of every user
+	password []byte // bcrypt hash
+}
+
+type userKey struct{}
+
+/*
+Read a users file in the htpasswd format written by "htpasswd -B", one user per line:
+
+	name:bcrypt-hash[:admin]
+
+Lines starting with # are ignored
+*/
+func ReadUsers(path string) (map[string]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || !USER_RE.MatchString(fields[0]) {
+			return nil, fmt.Errorf("%s:%d: expected name:bcrypt-hash[:admin]", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash: %s", path, n, fields[0], err)
+		}
+		u := &User{Name: fields[0], password: []byte(fields[1])}
+		if len(fields) == 3 {
+			if fields[2] != "admin" {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", path, n, fields[2])
+			}
+			u.Admin = true
+		}
+		users[u.Name] = u
+	}
+	return users, scanner.Err()
+}
+
+// Whether authentication is turned on at all
+func (s *Server) authEnabled() bool {
+	return s.users != nil || s.ProxyAuth != ""
+}
+
+/*
+Work out who made the request, from the trusted proxy header or the basic auth credentials
+checked against the users file. Proxy users are admins if they are in --proxy-admins
+*/
+func (s *Server) authenticate(r *http.Request) (*User, error) {
+	if s.ProxyAuth != "" {
+		name := r.Header.Get(s.ProxyAuth)
+		if name == "" {
+			return nil, fmt.Errorf("no %s header", s.ProxyAuth)
+		}
+		if !USER_RE.MatchString(name) {
+			return nil, fmt.Errorf("invalid user name %q", name)
+		}
+		u := &User{Name: name}
+		for _, admin := range s.ProxyAdmins {
+			if admin == name {
+				u.Admin = true
+			}
+		}
+		return u, nil
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("no credentials")
+	}
+	u, ok := s.users[name]
+	if !ok || bcrypt.CompareHashAndPassword(u.password, []byte(password)) != nil {
+		return nil, fmt.Errorf("invalid credentials for %q", name)
+	}
+	return u, nil
+}
+
+// Require a user for every request when authentication is on
+func (s *Server) requireAuth(handler http.Handler) http.Handler {
+	if !s.authEnabled() {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.authenticate(r)
+		if err != nil {
+			log.Println(r.RemoteAddr, r.RequestURI, http.StatusUnauthorized, err)
+			if s.users != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="godm", charset="UTF-8"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorized"))
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// The user of the request, nil when authentication is off
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+	return u
+}
+
+// Whether the user may see the job. Everyone sees everything when authentication is off
+func (u *User) CanSee(j Job) bool {
+	return u == nil || u.Admin || j.Owner == u.Name
+}
+
+// Owner recorded on the jobs of the user
+func (u *User) owner() string {
+	if u == nil {
+		return ""
+	}
+	return u.Name
+}
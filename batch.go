@@ -0,0 +1,190 @@
+package godm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// BookResult is how one book of a batch download went
+type BookResult struct {
+	Odm      string
+	Title    string
+	Dir      string
+	Status   string // The last step reached, e.g. downloaded, returned or parsed
+	Err      error
+	Duration time.Duration
+}
+
+/*
+Split the download arguments into ODM files and the out directory, which is always last.
+Globs are expanded here so they also work from shells that do not expand them
+*/
+func expandODMs(paths []string) ([]string, string, error) {
+	if len(paths) < 2 {
+		return nil, "", fmt.Errorf("expected at least one ODM file and the directory to save to")
+	}
+	outdir := paths[len(paths)-1]
+	if strings.HasSuffix(strings.ToLower(outdir), ".odm") {
+		return nil, "", fmt.Errorf("the last argument must be the directory to save to, not %s", outdir)
+	}
+	seen := make(map[string]bool)
+	odms := make([]string, 0)
+	for _, pattern := range paths[:len(paths)-1] {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid glob %s: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, "", fmt.Errorf("no ODM files match %s", pattern)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				odms = append(odms, m)
+			}
+		}
+	}
+	return odms, outdir, nil
+}
+
+// Run every book through a queue of d.Books workers, a failed book does not stop the others
+func (d *Download) downloadAll() []*BookResult {
+	results := make([]*BookResult, len(d.odms))
+	queue := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < d.Books; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = d.downloadBook(d.odms[i])
+			}
+		}()
+	}
+	for i := range d.odms {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// Download, validate and optionally return and parse a single book
+func (d *Download) downloadBook(odmfile string) *BookResult {
+	start := time.Now()
+	r := &BookResult{Odm: odmfile, Status: "queued"}
+	r.Err = d.runBook(odmfile, r)
+	r.Duration = time.Since(start).Round(time.Second)
+	if r.Err != nil {
+		fmt.Printf("[%s] Failed after %s: %s\n", filepath.Base(odmfile), r.Status, r.Err)
+	}
+	return r
+}
+
+func (d *Download) runBook(odmfile string, r *BookResult) error {
+	name := filepath.Base(odmfile)
+	logf := func(format string, a ...interface{}) {
+		fmt.Printf("[%s] %s\n", name, fmt.Sprintf(format, a...))
+	}
+
+	logf("Parsing ODM file")
+	odm, err := NewODMFile(odmfile)
+	if err != nil {
+		return err
+	}
+	md, err := odm.GetMetadata()
+	if err != nil {
+		return err
+	}
+	r.Title = md.Title
+	r.Dir = filepath.Join(d.outdir, md.GetFolderName())
+	if err := odm.SelectFormat(d.Format, d.Quality); err != nil {
+		return err
+	}
+	odm.SetLimiter(d.limiter)
+	logf("Using format %s", odm.chooseBestFormat())
+	logf("Acquiring License")
+	if _, err := odm.GetLicense(); err != nil {
+		return err
+	}
+	r.Status = "licensed"
+
+	logf("Downloading all parts")
+	if err := odm.Download(d.outdir, d.Threads, d.Verbose, d.CoverFromParts); err != nil {
+		return err
+	}
+	if err := VerifyParts(odm.chooseBestFormat(), r.Dir); err != nil {
+		return err
+	}
+	r.Status = "downloaded"
+
+	if d.Return {
+		logf("Returning book")
+		if err := odm.Return(); err != nil {
+			return err
+		}
+		r.Status = "returned"
+	}
+
+	if d.Parse {
+		logf("Splitting chapters")
+		parser := ParseChapters{
+			logfile:        &prefixWriter{prefix: "[" + name + "] ", w: os.Stdout},
+			Directory:      r.Dir,
+			Odm:            filepath.Join(r.Dir, name),
+			ChapterOptions: d.ChapterOptions,
+		}
+		if err := parser.Run(); err != nil {
+			return err
+		}
+		r.Status = "parsed"
+	}
+	logf("Done")
+	return nil
+}
+
+// Print a line for every book of the batch
+func printSummary(w io.Writer, results []*BookResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nRESULT\tSTATUS\tTIME\tBOOK\tDETAILS")
+	for _, r := range results {
+		result, details := "OK", r.Dir
+		if r.Err != nil {
+			result, details = "FAILED", r.Err.Error()
+		}
+		book := r.Title
+		if book == "" {
+			book = r.Odm
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result, r.Status, r.Duration, book, details)
+	}
+	tw.Flush()
+}
+
+// prefixWriter writes every line with a prefix so the logs of books parsed at once can be told apart
+type prefixWriter struct {
+	mu     sync.Mutex
+	prefix string
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lines := strings.SplitAfter(string(b), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(p.w, p.prefix+line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,140 @@
+package godm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Config is a YAML (or JSON) file of flag values, given by --config or GODM_CONFIG. Top level
+settings apply to every command, a section named after a command only to that command:
+
+	threads: 4
+	format: mp3
+	server:
+	  address: ":9000"
+	  max-concurrent-jobs: 2
+	  retention: 720h
+
+Settings are named like the flags, with - or _. Flags win over environment variables, which
+win over the file, which wins over the defaults. Arguments can only be given on the command line
+*/
+type Config struct {
+	path     string
+	global   map[string]interface{}
+	commands map[string]map[string]interface{}
+}
+
+// Read a config file
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	c := &Config{path: path, global: map[string]interface{}{}, commands: map[string]map[string]interface{}{}}
+	for key, value := range values {
+		key = configKey(key)
+		if section, ok := value.(map[string]interface{}); ok {
+			c.commands[key] = map[string]interface{}{}
+			for k, v := range section {
+				c.commands[key][configKey(k)] = v
+			}
+			continue
+		}
+		c.global[key] = value
+	}
+	return c, nil
+}
+
+func configKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// Resolve the value of a flag, nil if the file does not set it or the environment does
+func (c *Config) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if flag.Tag.Env != "" && os.Getenv(flag.Tag.Env) != "" {
+		return nil, nil
+	}
+	if parent.Command != nil {
+		if value, ok := c.commands[parent.Command.Name][flag.Name]; ok {
+			return value, nil
+		}
+	}
+	if value, ok := c.global[flag.Name]; ok {
+		return value, nil
+	}
+	return nil, nil
+}
+
+// Check every setting in the file is a flag, so typos are not silently ignored
+func (c *Config) Validate(app *kong.Application) error {
+	flags := map[string]bool{}
+	commands := map[string]map[string]bool{}
+	for _, node := range append([]*kong.Node{app.Node}, app.Leaves(true)...) {
+		names := map[string]bool{}
+		// A command has the flags of its parents too
+		for n := node; n != nil; n = n.Parent {
+			for _, flag := range n.Flags {
+				names[flag.Name] = true
+				flags[flag.Name] = true
+			}
+		}
+		if node.Type == kong.CommandNode {
+			commands[node.Name] = names
+		}
+	}
+
+	var unknown []string
+	for key := range c.global {
+		if !flags[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	for command, values := range c.commands {
+		names, ok := commands[command]
+		if !ok {
+			unknown = append(unknown, command)
+			continue
+		}
+		for key := range values {
+			if !names[key] {
+				unknown = append(unknown, command+"."+key)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings %s", c.path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Load the config file, if there is one, before the flags are resolved
+func (a *App) BeforeResolve(ctx *kong.Context) error {
+	// The flag is only applied after resolving, so look for it on the command line
+	path := a.Config
+	for _, trace := range ctx.Path {
+		if trace.Flag != nil && trace.Flag.Name == "config" {
+			path = ctx.FlagValue(trace.Flag).(string)
+		}
+	}
+	if path == "" {
+		return nil
+	}
+	c, err := LoadConfig(kong.ExpandPath(path))
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(c)
+	return nil
+}
@@ -0,0 +1,196 @@
+package godm
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	v2 "github.com/mikkyang/id3-go/v2"
+)
+
+// Largest cover overdrive will send, anything bigger is not a cover
+const MaxCoverSize = 20 << 20
+
+// Overdrive cover urls end in e.g. ImageType-100/0111-1/{GUID}Img100.jpg, the type is the size
+var COVER_RE = regexp.MustCompile(`ImageType-[0-9]+/(.+)Img[0-9]+\.([a-z]+)$`)
+
+// Image types to try, largest first. 100 is the normal cover, 200 the thumbnail
+var CoverTypes = []string{"400", "100"}
+
+// Cover is a validated cover image
+type Cover struct {
+	Source      string // URL or part the cover came from
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+func (c *Cover) String() string {
+	return fmt.Sprintf("%dx%d %s from %s", c.Width, c.Height, c.ContentType, c.Source)
+}
+
+// Check the data is an image and get its size
+func NewCover(source string, data []byte) (*Cover, error) {
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("%s is not an image: %s", source, contentType)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid image: %s", source, err)
+	}
+	return &Cover{
+		Source:      source,
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+		Data:        data,
+	}, nil
+}
+
+// Urls to try for the cover, the larger variants of CoverUrl first
+func coverCandidates(md *Metadata) []string {
+	urls := make([]string, 0)
+	if m := COVER_RE.FindStringSubmatchIndex(md.CoverUrl); m != nil {
+		prefix := md.CoverUrl[:m[0]]
+		name := md.CoverUrl[m[2]:m[3]]
+		ext := md.CoverUrl[m[4]:m[5]]
+		for _, t := range CoverTypes {
+			urls = append(urls, fmt.Sprintf("%sImageType-%s/%sImg%s.%s", prefix, t, name, t, ext))
+		}
+	}
+	for _, url := range urls {
+		if url == md.CoverUrl {
+			return urls
+		}
+	}
+	if md.CoverUrl != "" {
+		urls = append(urls, md.CoverUrl)
+	}
+	return urls
+}
+
+func fetchCover(client *http.Client, url string) (*Cover, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code received for %s: %d", url, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") {
+		return nil, fmt.Errorf("%s is not an image: %s", url, ct)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxCoverSize))
+	if err != nil {
+		return nil, err
+	}
+	return NewCover(url, data)
+}
+
+/*
+Download the highest resolution cover available. Each size of CoverUrl is tried and the largest
+valid image wins, the thumbnail is only used if none of them work
+*/
+func FetchCover(client *http.Client, md *Metadata) (*Cover, error) {
+	var best *Cover
+	errs := make([]string, 0)
+	for _, url := range coverCandidates(md) {
+		c, err := fetchCover(client, url)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if best == nil || c.Width*c.Height > best.Width*best.Height {
+			best = c
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if md.ThumbnailUrl != "" {
+		c, err := fetchCover(client, md.ThumbnailUrl)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no cover url in the ODM")
+	}
+	return nil, fmt.Errorf("could not download cover: %s", strings.Join(errs, "; "))
+}
+
+// Get the largest picture embedded in the APIC frames of the parts
+func CoverFromParts(paths []string) (*Cover, error) {
+	var best *Cover
+	for _, path := range paths {
+		f, err := OpenTag(path)
+		if err != nil {
+			continue
+		}
+		for _, frame := range f.Frames("APIC") {
+			img, ok := frame.(*v2.ImageFrame)
+			if !ok {
+				continue
+			}
+			c, err := NewCover(path, img.Data())
+			if err != nil {
+				continue
+			}
+			if best == nil || c.Width*c.Height > best.Width*best.Height {
+				best = c
+			}
+		}
+		f.Close()
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no cover embedded in the parts")
+	}
+	return best, nil
+}
+
+/*
+Save the cover of the book to folder.jpg in outdir, unless a valid one is already there. If the
+cover cannot be downloaded and fromParts is set, the picture embedded in the parts is used
+*/
+func (o *OverDriveMedia) SaveCover(outdir string, fromParts bool) (*Cover, error) {
+	albumArt := filepath.Join(outdir, "folder.jpg")
+	if data, err := ioutil.ReadFile(albumArt); err == nil && len(data) != 0 {
+		if c, err := NewCover(albumArt, data); err == nil {
+			return c, nil
+		}
+	}
+
+	md, err := o.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+	c, err := FetchCover(&http.Client{}, md)
+	if err != nil && fromParts {
+		parts := make([]string, 0)
+		for _, part := range o.chooseBestFormat().Parts.Part {
+			parts = append(parts, filepath.Join(outdir, part.LocalName()))
+		}
+		var partsErr error
+		if c, partsErr = CoverFromParts(parts); partsErr != nil {
+			return nil, fmt.Errorf("%s; %s", err, partsErr)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, ioutil.WriteFile(albumArt, c.Data, 0644)
+}
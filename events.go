@@ -0,0 +1,116 @@
+package godm
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of job events
+const (
+	EventJob      = "job"      // The job changed state, Job holds all of it
+	EventProgress = "progress" // The parts downloaded more, Job holds all of it
+	EventLog      = "log"      // A line was written to the job log
+)
+
+// Event is something that happened to a job, streamed to the status page
+type Event struct {
+	Type    string    `json:"type"`
+	JobId   string    `json:"job"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level,omitempty"` // LOG or ERR for log events
+	Message string    `json:"message,omitempty"`
+	Job     *apiJob   `json:"data,omitempty"`
+}
+
+// Make a log event from a line sent to the job log, e.g. "ERR: Missing part 3"
+func logEvent(id, line string) Event {
+	line = stripLogTime(line)
+	e := Event{Type: EventLog, JobId: id, Time: time.Now(), Level: "LOG", Message: line}
+	for _, level := range []string{"LOG", "ERR"} {
+		if strings.HasPrefix(line, level+": ") {
+			e.Level, e.Message = level, strings.TrimPrefix(line, level+": ")
+		}
+	}
+	return e
+}
+
+// Lines in the log file start with the time as printed by %+v, ending in the monotonic clock
+func stripLogTime(line string) string {
+	i := strings.Index(line, " m=+")
+	if i < 0 {
+		return line
+	}
+	if j := strings.Index(line[i+1:], " "); j >= 0 {
+		return line[i+1+j+1:]
+	}
+	return line
+}
+
+// Event with a snapshot of the job
+func jobEvent(kind string, j Job) Event {
+	aj := newApiJob(j)
+	return Event{Type: kind, JobId: j.Id, Time: time.Now(), Job: &aj}
+}
+
+// EventBus sends the events of a job to everyone watching it
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[string]map[chan Event]bool)}
+}
+
+/*
+Watch the events of a job until cancel is called. Slow watchers miss events rather than
+holding up the download
+*/
+func (b *EventBus) Subscribe(id string) (chan Event, func()) {
+	c := make(chan Event, 64)
+	b.mu.Lock()
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[chan Event]bool)
+	}
+	b.subs[id][c] = true
+	b.mu.Unlock()
+	return c, func() {
+		b.mu.Lock()
+		delete(b.subs[id], c)
+		if len(b.subs[id]) == 0 {
+			delete(b.subs, id)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Send the event to the watchers of its job. Safe to call on nil
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.subs[e.JobId] {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// eventWriter publishes every line written to it as a log event of the job
+type eventWriter struct {
+	bus *EventBus
+	id  string
+}
+
+func (w *eventWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if line != "" {
+			w.bus.Publish(logEvent(w.id, line))
+		}
+	}
+	return len(b), nil
+}
@@ -1,33 +1,335 @@
 package godm
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+// Lines printed by ffmpeg's silencedetect filter, e.g.
+// [silencedetect @ 0x55d0] silence_start: 1804.52
+// [silencedetect @ 0x55d0] silence_end: 1807.1 | silence_duration: 2.58
+var (
+	SILENCE_START_RE = regexp.MustCompile(`silence_start:\s*(-?[0-9.]+)`)
+	SILENCE_END_RE   = regexp.MustCompile(`silence_end:\s*(-?[0-9.]+)`)
+)
+
+// Codecs chapters can be written in. CodecCopy keeps the original audio untouched
+const (
+	CodecCopy = "copy"
+	CodecMP3  = "mp3"
+	CodecAAC  = "aac"
+	CodecOpus = "opus"
+)
+
+// Loudness targets for EBU R128 normalization
+const (
+	LoudnessTarget = -16.0 // Integrated loudness in LUFS
+	LoudnessPeak   = -1.5  // True peak in dBTP
+	LoudnessRange  = 11.0  // Loudness range in LU
+)
+
+// AudioOptions controls how the chapters are encoded. The zero value copies the audio as is
+type AudioOptions struct {
+	Codec     string  `help:"Codec of the chapters: copy, mp3, aac or opus. Anything but copy re-encodes the audio" enum:"copy,mp3,aac,opus" default:"copy"`
+	Bitrate   string  `help:"Bitrate of the chapters, e.g. 64k. With --codec=copy the mp3 is re-encoded at this bitrate"`
+	Normalize bool    `help:"Normalize the loudness of each chapter to EBU R128 (re-encodes)"`
+	Mono      bool    `help:"Down-mix the chapters to mono (re-encodes)"`
+	Speed     float64 `help:"Playback speed to bake into the chapters, e.g. 1.25 (re-encodes)" default:"1"`
+}
+
+// Whether the audio has to be re-encoded rather than copied
+func (a AudioOptions) Reencode() bool {
+	return a.codec() != CodecCopy || a.Bitrate != "" || a.Normalize || a.Mono || a.speed() != 1
+}
+
+func (a AudioOptions) codec() string {
+	if a.Codec == "" {
+		return CodecCopy
+	}
+	return a.Codec
+}
+
+func (a AudioOptions) speed() float64 {
+	if a.Speed <= 0 {
+		return 1
+	}
+	return a.Speed
+}
+
+// Extension of the chapter files
+func (a AudioOptions) Ext() string {
+	switch a.codec() {
+	case CodecAAC:
+		return ".m4a"
+	case CodecOpus:
+		return ".opus"
+	}
+	return ".mp3"
+}
+
+// How long a chapter of the given length will be once the speed is applied
+func (a AudioOptions) Length(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / a.speed())
+}
+
+// ffmpeg arguments to encode the audio
+func (a AudioOptions) args() []string {
+	if !a.Reencode() {
+		return []string{"-acodec", "copy"}
+	}
+
+	args := make([]string, 0)
+	switch a.codec() {
+	case CodecAAC:
+		args = append(args, "-vn", "-acodec", "aac")
+	case CodecOpus:
+		args = append(args, "-vn", "-acodec", "libopus")
+	default:
+		// Changing the audio of an mp3 still needs an mp3 encoder
+		args = append(args, "-acodec", "libmp3lame")
+	}
+	if a.Bitrate != "" {
+		args = append(args, "-b:a", a.Bitrate)
+	}
+	if a.Mono {
+		args = append(args, "-ac", "1")
+	}
+
+	filters := make([]string, 0)
+	if a.speed() != 1 {
+		filters = append(filters, atempo(a.speed())...)
+	}
+	if a.Normalize {
+		filters = append(filters, fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", LoudnessTarget, LoudnessPeak, LoudnessRange))
+	}
+	if len(filters) != 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	return args
+}
+
+// Older ffmpeg only accepts atempo between 0.5 and 2, chain filters to reach any speed
+func atempo(speed float64) []string {
+	filters := make([]string, 0)
+	for speed > 2 {
+		filters = append(filters, "atempo=2")
+		speed /= 2
+	}
+	for speed < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		speed /= 0.5
+	}
+	return append(filters, fmt.Sprintf("atempo=%g", speed))
+}
+
 func SplitMP3(filename, destination string, marker *Marker) error {
+	return SplitAudio(filename, destination, marker, AudioOptions{})
+}
+
+/*
+Write a chapter to destination. Copied audio is cut after decoding as before, re-encoded audio
+is cut on the input so the times are not changed by the speed filter
+*/
+func SplitAudio(filename, destination string, marker *Marker, opts AudioOptions) error {
+	cut := []string{"-ss", FormatMarkerTime(marker.Start)}
+	if marker.End > 0 {
+		cut = append(cut, "-to", FormatMarkerTime(marker.End))
+	}
 
 	comm := []string{
+		"-y", // Replace chapters from an earlier run
+	}
+	if opts.Reencode() {
+		comm = append(comm, cut...)
+		comm = append(comm, "-i", filename)
+		comm = append(comm, opts.args()...)
+	} else {
+		comm = append(comm, "-i", filename)
+		comm = append(comm, opts.args()...)
+		comm = append(comm, cut...)
+	}
+	comm = append(comm, destination)
+
+	com := exec.Command("ffmpeg", comm...)
+	stderr := new(bytes.Buffer)
+	com.Stderr = stderr
+	if err := com.Run(); err != nil {
+		fmt.Println("ffmpeg", strings.Join(comm, " "))
+		return fmt.Errorf("%s %s", err, stderr.String())
+	}
+	return nil
+}
+
+/*
+Embed a cover image into a chapter, as an APIC frame for mp3 and an attached picture for m4a.
+The chapter is rewritten next to itself and then moved over the original
+*/
+func EmbedCover(filename, cover string) error {
+	ext := filepath.Ext(filename)
+	if ext == ".opus" {
+		return fmt.Errorf("cannot embed cover art in opus files")
+	}
+	tmp := strings.TrimSuffix(filename, ext) + ".cover" + ext
+	comm := []string{
+		"-y",
+		"-i",
+		filename,
 		"-i",
-		"" + filename + "",
-		"-acodec",
+		cover,
+		"-map",
+		"0:a",
+		"-map",
+		"1:v",
+		"-c",
 		"copy",
-		"-ss",
-		marker.Time,
+		"-disposition:v",
+		"attached_pic",
+		"-metadata:s:v",
+		"title=Album cover",
+		"-metadata:s:v",
+		"comment=Cover (front)",
 	}
+	if ext == ".mp3" {
+		comm = append(comm, "-id3v2_version", "3")
+	}
+	comm = append(comm, tmp)
+	com := exec.Command("ffmpeg", comm...)
+	stderr := new(bytes.Buffer)
+	com.Stderr = stderr
+	if err := com.Run(); err != nil {
+		os.Remove(tmp)
+		fmt.Println("ffmpeg", strings.Join(comm, " "))
+		return fmt.Errorf("%s %s", err, stderr.String())
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Silence is a quiet section of an audio file
+type Silence struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (s Silence) Duration() time.Duration {
+	return s.End - s.Start
+}
 
-	if marker.EndTime != "" {
-		comm = append(comm, "-to", marker.EndTime)
+// Midpoint of the silence, this is where a chapter break is placed
+func (s Silence) Middle() time.Duration {
+	return s.Start + s.Duration()/2
+}
+
+/*
+Find all the silences in a file that are quieter than noise (in dB) for at least minGap.
+Uses ffmpeg's silencedetect filter, decoding the whole file so this is slow for long parts
+*/
+func DetectSilence(filename string, noise float64, minGap time.Duration) ([]Silence, error) {
+	comm := []string{
+		"-nostats",
+		"-i",
+		filename,
+		"-af",
+		fmt.Sprintf("silencedetect=noise=%gdB:d=%g", noise, minGap.Seconds()),
+		"-f",
+		"null",
+		"-",
 	}
-	comm = append(comm, destination)
 	com := exec.Command("ffmpeg", comm...)
-	stderr, _ := com.StderrPipe()
+	stderr := new(bytes.Buffer)
+	com.Stderr = stderr
 	if err := com.Run(); err != nil {
 		fmt.Println("ffmpeg", strings.Join(comm, " "))
-		o, _ := ioutil.ReadAll(stderr)
-		return fmt.Errorf("%s %s", err, o)
+		return nil, fmt.Errorf("%s %s", err, stderr.String())
 	}
-	return nil
+
+	silences := make([]Silence, 0)
+	var start *time.Duration
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := SILENCE_START_RE.FindStringSubmatch(line); m != nil {
+			s, err := time.ParseDuration(m[1] + "s")
+			if err != nil {
+				continue
+			}
+			if s < 0 {
+				s = 0
+			}
+			start = &s
+			continue
+		}
+		if m := SILENCE_END_RE.FindStringSubmatch(line); m != nil && start != nil {
+			e, err := time.ParseDuration(m[1] + "s")
+			if err != nil {
+				continue
+			}
+			silences = append(silences, Silence{Start: *start, End: e})
+			start = nil
+		}
+	}
+	return silences, scanner.Err()
+}
+
+/*
+Choose chapter breaks from a list of silences. If count is above 0 only the count longest
+silences are used. The breaks are returned in order from the start of the file
+*/
+func ChooseBreaks(silences []Silence, count int) []time.Duration {
+	candidates := make([]Silence, 0, len(silences))
+	for _, s := range silences {
+		// A silence at the very start of the file is not a chapter break
+		if s.Start <= 0 {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	if count > 0 && len(candidates) > count {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Duration() > candidates[j].Duration()
+		})
+		candidates = candidates[:count]
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Start < candidates[j].Start
+	})
+
+	breaks := make([]time.Duration, 0, len(candidates))
+	for _, s := range candidates {
+		breaks = append(breaks, s.Middle())
+	}
+	return breaks
+}
+
+// Get the length of an audio file with ffprobe
+func Duration(filename string) (time.Duration, error) {
+	comm := []string{
+		"-v",
+		"error",
+		"-show_entries",
+		"format=duration",
+		"-of",
+		"default=noprint_wrappers=1:nokey=1",
+		filename,
+	}
+	com := exec.Command("ffprobe", comm...)
+	stderr := new(bytes.Buffer)
+	com.Stderr = stderr
+	out, err := com.Output()
+	if err != nil {
+		fmt.Println("ffprobe", strings.Join(comm, " "))
+		return 0, fmt.Errorf("%s %s", err, stderr.String())
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(string(out)) + "s")
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration from ffprobe: %s", out)
+	}
+	return d, nil
 }
@@ -1,13 +1,15 @@
 module godm
 
-go 1.17
+go 1.18
 
 require (
 	github.com/alecthomas/kong v0.2.18
 	github.com/google/uuid v1.3.0
 	github.com/mikkyang/id3-go v0.0.0-20191012064224-2c6ab3bb1fbd
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/mod v0.5.1
 	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
@@ -8,7 +8,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 //go:embed static/*
@@ -18,44 +21,113 @@ var Files embed.FS
 var index string
 var Templates = template.Must(template.New("").Parse(index))
 
+//go:embed status.html
+var statusPage string
+var _ = template.Must(Templates.New("status").Parse(statusPage))
+
+//go:embed dashboard.html
+var dashboardPage string
+var _ = template.Must(Templates.New("dashboard").Parse(dashboardPage))
+
+//go:embed library.html
+var libraryPage string
+var _ = template.Must(Templates.New("library").Parse(libraryPage))
+
 type App struct {
-	Download Download      `cmd help:"Download the ODM file contents"`
-	Return   Return        `cmd help:"Return the ODM file"`
-	Server   Server        `cmd help:"Serve a website to automatically download books"`
-	Parse    ParseChapters `cmd help:"Split the different parts into the correct chapters"`
+	Download Download      `cmd:"" help:"Download the ODM file contents"`
+	Return   Return        `cmd:"" help:"Return the ODM file"`
+	Server   Server        `cmd:"" help:"Serve a website to automatically download books"`
+	Parse    ParseChapters `cmd:"" help:"Split the different parts into the correct chapters"`
+	Restore  Restore       `cmd:"" help:"Restore the original parts from the zip made by parse"`
+	Info     Info          `cmd:"" help:"Show the book and every format in the ODM file"`
+	Verify   Verify        `cmd:"" help:"Check a book or a whole library for missing or corrupt files"`
+
+	Config string `help:"YAML or JSON file of flag values, top level for every command or in a section named after the command" env:"GODM_CONFIG" type:"path"`
+}
+
+// Set at build time with -ldflags "-X godm.version=..."
+var version = ""
+
+// The godm version, from the build flags or the module version
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "devel"
 }
 
 type Download struct {
-	Odm     string `arg help:"ODM File to parse"`
-	Outdir  string `arg help:"out directory to save files to"`
-	Return  bool   `short:"r" help:"return the book when successfully downloaded"`
-	Verbose bool   `short:"v" help:"Print more information"`
+	Paths   []string `arg:"" name:"odm" help:"ODM files or globs to download, followed by the directory to save them to"`
+	Return  bool     `short:"r" help:"return each book when it is successfully downloaded"`
+	Verbose bool     `short:"v" help:"Print more information"`
+	Parse   bool     `short:"p" help:"Split the chapters of each book once it is downloaded"`
+	Books   int      `short:"b" help:"Number of books to download at once" default:"1"`
+
+	CoverFromParts bool   `help:"Use the cover embedded in the parts if it cannot be downloaded"`
+	Format         string `help:"Format to download, matched against the format name and type e.g. mp3"`
+	Quality        string `help:"Quality to download: low, medium or high. Defaults to the highest"`
+	Threads        int    `short:"t" help:"Number of parts to download at once" default:"10"`
+	LimitRate      string `help:"Maximum download speed for all parts together, e.g. 500K or 2M"`
+
+	ChapterOptions
+
+	odms    []string
+	outdir  string
+	limiter *RateLimiter
 }
 
 func (d *Download) Run() error {
-	fmt.Println("Parsing ODM file")
-	odm, err := NewODMFile(d.Odm)
+	odms, outdir, err := expandODMs(d.Paths)
 	if err != nil {
 		return err
 	}
-	fmt.Println("Acquiring License")
-	if _, err := odm.GetLicense(); err != nil {
-		return err
+	d.odms, d.outdir = odms, outdir
+	if d.Books < 1 || d.Threads < 1 {
+		return fmt.Errorf("--books and --threads must be at least 1")
+	}
+	if d.Parse {
+		p := &ParseChapters{ChapterOptions: d.ChapterOptions}
+		if err := p.validateOriginals(); err != nil {
+			return err
+		}
+		if err := ValidateSidecars(d.Sidecars); err != nil {
+			return err
+		}
+		if err := d.validateAudio(); err != nil {
+			return err
+		}
 	}
-	fmt.Println("Downloading all parts")
-	if err = odm.Download(d.Outdir, 10, d.Verbose); err != nil {
+	rate, err := ParseRate(d.LimitRate)
+	if err != nil {
 		return err
 	}
-	// TODO Validate the download worked
-	if d.Return {
-		fmt.Println("Returning book")
-		return odm.Return()
+	// One limiter for every book so the limit holds for the whole batch
+	d.limiter = NewRateLimiter(rate)
+
+	results := d.downloadAll()
+	if len(results) > 1 {
+		printSummary(os.Stdout, results)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed == len(results) && len(results) == 1 {
+		return results[0].Err
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d books failed", failed, len(results))
 	}
 	return nil
 }
 
 type Return struct {
-	Odm string `arg help:"ODM File to return"`
+	Odm string `arg:"" help:"ODM File to return"`
 }
 
 func (r *Return) Run() error {
@@ -68,37 +140,161 @@ func (r *Return) Run() error {
 	return odm.Return()
 }
 
+type Info struct {
+	Odm string `arg:"" help:"ODM File to show"`
+}
+
+func (i *Info) Run() error {
+	odm, err := NewODMFile(i.Odm)
+	if err != nil {
+		return err
+	}
+	md, err := odm.GetMetadata()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Title:   ", md.Title)
+	fmt.Println("Author:  ", md.GetAuthor())
+	if narrator := md.GetNarrator(); narrator != "" {
+		fmt.Println("Narrator:", narrator)
+	}
+	fmt.Println("Id:      ", odm.Id)
+	if odm.DrmInfo.ExpirationDate != "" {
+		fmt.Println("Expires: ", odm.DrmInfo.ExpirationDate)
+	}
+	best := odm.chooseBestFormat()
+	fmt.Println("Formats:")
+	for _, f := range odm.Formats.Formats {
+		def := ""
+		if f.Name == best.Name && f.Type == best.Type && f.Quality.Level == best.Quality.Level {
+			def = " (default)"
+		}
+		fmt.Printf("  %s: %d parts, %s%s\n", f, len(f.Parts.Part), HumanSize(f.Size()), def)
+	}
+	return nil
+}
+
+// Format a size in bytes for people
+func HumanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	s := float64(size)
+	i := 0
+	for s >= 1024 && i < len(units)-1 {
+		s /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", s, units[i])
+}
+
 type Server struct {
-	Address string `short:"a" help:"Address to listen on (env GODM_ADDR)" default:":8080"`
-	Prefix  string `short:"p" help:"URL prefix to use (env GODM_PREFIX)"`
-	Outdir  string `arg help:"out directory to save files to (env GODM_OUTDIR)"`
+	Address string `short:"a" help:"Address to listen on" default:":8080" env:"GODM_ADDR"`
+	Prefix  string `short:"p" help:"URL prefix to use" env:"GODM_PREFIX"`
+	Outdir  string `arg:"" help:"out directory to save files to" env:"GODM_OUTDIR"`
 	Verbose bool   `short:"v" help:"Print more information"`
+
+	CoverFromParts bool   `help:"Use the cover embedded in the parts if it cannot be downloaded"`
+	Format         string `help:"Format to download, matched against the format name and type e.g. mp3" env:"GODM_FORMAT"`
+	Quality        string `help:"Quality to download: low, medium or high. Defaults to the highest" env:"GODM_QUALITY"`
+	ThreadsPerJob  int    `short:"t" help:"Number of parts to download at once for each book" default:"10" env:"GODM_THREADS_PER_JOB"`
+	LimitRate      string `help:"Maximum download speed shared by all books, e.g. 500K or 2M" env:"GODM_LIMIT_RATE"`
+	QuietHours     string `help:"Do not start downloading parts between these times, e.g. 23:00-07:00" env:"GODM_QUIET_HOURS"`
+
+	MaxConcurrentJobs int           `short:"j" help:"Number of books to download at once, the rest wait in the queue" default:"1" env:"GODM_MAX_CONCURRENT_JOBS"`
+	DataDir           string        `help:"Directory for the job queue, job logs and uploaded ODMs" default:"odms" env:"GODM_DATA_DIR"`
+	MaxUploadSize     string        `help:"Largest ODM file accepted, e.g. 16K. ODMs are only a few KB" default:"9999" env:"GODM_MAX_UPLOAD_SIZE"`
+	Retention         time.Duration `help:"Forget finished jobs and their ODMs after this long, e.g. 720h. Kept until deleted when 0" default:"0" env:"GODM_RETENTION"`
+
+	Users       string   `help:"Users who may log in, lines of name:bcrypt-hash[:admin] as written by htpasswd -B" type:"existingfile" env:"GODM_USERS"`
+	ProxyAuth   string   `help:"Trust this header from a reverse proxy for the user name, e.g. X-Forwarded-User. Cannot be used with --users" env:"GODM_PROXY_AUTH"`
+	ProxyAdmins []string `help:"Users from the --proxy-auth header who see the jobs and books of everyone" env:"GODM_PROXY_ADMINS"`
+
+	limiter       *RateLimiter
+	quiet         *QuietHours
+	jobs          *JobQueue
+	events        *EventBus
+	users         map[string]*User
+	positions     *PositionStore
+	maxUploadSize int64
 }
 
 func (s *Server) Run() error {
-	if pr := os.Getenv("GODM_PREFIX"); pr != "" {
-		s.Prefix = pr
+	if s.ThreadsPerJob <= 0 {
+		return fmt.Errorf("threads per job must be at least 1")
+	}
+	if s.MaxConcurrentJobs <= 0 {
+		return fmt.Errorf("max concurrent jobs must be at least 1")
+	}
+	if s.Retention < 0 {
+		return fmt.Errorf("retention cannot be negative")
+	}
+
+	// One limiter for every book so the limit holds however many are downloading
+	rate, err := ParseRate(s.LimitRate)
+	if err != nil {
+		return err
+	}
+	s.limiter = NewRateLimiter(rate)
+	if s.quiet, err = ParseQuietHours(s.QuietHours); err != nil {
+		return err
+	}
+	if s.maxUploadSize, err = ParseSize(s.MaxUploadSize); err != nil {
+		return err
 	}
-	if ad := os.Getenv("GODM_ADDR"); ad != "" {
-		s.Address = ad
+	if s.maxUploadSize <= 0 {
+		return fmt.Errorf("max upload size must be at least 1 byte")
+	}
+
+	// Anyone who can reach the server could send the header and skip the password
+	if s.ProxyAuth != "" && s.Users != "" {
+		return fmt.Errorf("--proxy-auth and --users cannot be used together")
 	}
-	if outdir := os.Getenv("GODM_OUTDIR"); outdir != "" {
-		s.Outdir = outdir
+	if len(s.ProxyAdmins) != 0 && s.ProxyAuth == "" {
+		return fmt.Errorf("--proxy-admins needs --proxy-auth")
 	}
 
 	if len(s.Prefix) != 0 && s.Prefix[0] != '/' {
 		return fmt.Errorf("URL prefix does not begin with '/'")
 	}
 
-	os.Mkdir("odms", 0755)
+	if err := os.MkdirAll(s.DataDir, 0755); err != nil {
+		return err
+	}
+	// Jobs that were running when the server stopped start again from the beginning,
+	// the parts already downloaded are skipped
+	s.events = NewEventBus()
+	if s.jobs, err = NewJobQueue(s.DataDir, s.MaxConcurrentJobs, s.DownloadForWeb, s.events); err != nil {
+		return err
+	}
+	s.jobs.Start()
+	if s.Retention > 0 {
+		go s.pruneJobs()
+	}
+	if s.positions, err = NewPositionStore(filepath.Join(s.DataDir, "positions")); err != nil {
+		return err
+	}
+
+	if s.Users != "" {
+		if s.users, err = ReadUsers(s.Users); err != nil {
+			return err
+		}
+	}
 
+	// Everything but the static files needs a user when authentication is on
+	app := http.NewServeMux()
+	app.HandleFunc("/", s.index)
+	app.HandleFunc("/upload", s.upload)
+	app.HandleFunc("/status", s.status)
+	app.HandleFunc("/jobs", s.dashboard)
+	app.HandleFunc("/library", s.library)
+	app.HandleFunc(apiPrefix, s.api)
 	routes := http.NewServeMux()
 	routes.Handle("/static/", http.FileServer(http.FS(Files)))
-	routes.HandleFunc("/", s.index)
-	routes.HandleFunc("/upload", s.upload)
-	routes.HandleFunc("/status", s.status)
+	routes.Handle("/", s.requireAuth(app))
 	lggr := logRequest(routes)
-	log.Println("Serving HTTP on", s.Address, "with prefix", s.Prefix, "saving to", s.Outdir)
+	log.Println("Serving HTTP on", s.Address, "with prefix", s.Prefix, "saving to", s.Outdir, "keeping jobs in", s.DataDir)
 	if len(s.Prefix) != 0 {
 		prefix := http.StripPrefix(s.Prefix, lggr)
 		return http.ListenAndServe(s.Address, prefix)
@@ -113,7 +309,7 @@ type data struct {
 }
 
 /* Worker that downloads requests to a file */
-func worker(wg *sync.WaitGroup, c chan data, e chan error, verbose bool) {
+func worker(wg *sync.WaitGroup, c chan data, e chan error, verbose bool, limiter *RateLimiter) {
 	defer wg.Done()
 	client := http.Client{}
 	for d := range c {
@@ -125,18 +321,28 @@ func worker(wg *sync.WaitGroup, c chan data, e chan error, verbose bool) {
 
 		resp, err := client.Do(d.r)
 		if err != nil {
+			f.Close()
 			e <- err
 			continue
 		}
 
-		_, err = io.Copy(f, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			f.Close()
+			e <- fmt.Errorf("invalid status code received for %s: %d", d.f, resp.StatusCode)
+			continue
+		}
+
+		_, err = io.Copy(f, limiter.Reader(resp.Body))
+		resp.Body.Close()
+		f.Close()
 		if err != nil {
 			e <- err
 			continue
 		}
 
 		if verbose {
-			log.Println("Saved file %s", d.f)
+			log.Println("Saved file", d.f)
 		}
 	}
 }
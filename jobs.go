@@ -0,0 +1,517 @@
+package godm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States a web job goes through, in order. Done and failed are final
+const (
+	JobQueued      = "queued"
+	JobLicensing   = "licensing"
+	JobDownloading = "downloading"
+	JobValidating  = "validating"
+	JobReturning   = "returning"
+	JobSplitting   = "splitting"
+	JobDone        = "done"
+	JobFailed      = "failed"
+)
+
+// Job is a book submitted to the server, saved as <dir>/<id>.json so it survives a restart
+type Job struct {
+	Id         string    `json:"id"`
+	Owner      string    `json:"owner,omitempty"` // User who uploaded it, empty without authentication
+	Name       string    `json:"name"`            // Filename the ODM was uploaded as
+	Odm        string    `json:"odm"`             // Where the ODM is stored, named by its sha256 so uploads of it share it
+	MediaId    string    `json:"media_id,omitempty"`
+	LinkedTo   string    `json:"linked_to,omitempty"`  // Job whose book this upload was linked to instead of downloading
+	Redownload bool      `json:"redownload,omitempty"` // Download every part again, even ones already there
+	Title      string    `json:"title,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Outdir     string    `json:"outdir,omitempty"`
+	Expires    string    `json:"expires,omitempty"` // When the loan of the book runs out
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	Returned   bool      `json:"returned"`
+	Created    time.Time `json:"created"`
+	Started    time.Time `json:"started,omitempty"`
+	Finished   time.Time `json:"finished,omitempty"`
+	Parts      []JobPart `json:"parts,omitempty"`
+}
+
+// States of a single part of a job
+const (
+	PartPending     = "pending"
+	PartDownloading = "downloading"
+	PartDone        = "done"
+	PartFailed      = "failed"
+)
+
+// JobPart is the download progress of one part of the book
+type JobPart struct {
+	Number     string `json:"number"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	State      string `json:"state"`
+}
+
+// Copy of the job that does not share its parts, safe to use without the queue lock
+func (j *Job) copy() Job {
+	c := *j
+	c.Parts = append([]JobPart(nil), j.Parts...)
+	return c
+}
+
+// Progress of the whole download from 0 to 1
+func (j *Job) Progress() float64 {
+	total, done := int64(0), int64(0)
+	for _, p := range j.Parts {
+		total += p.Size
+		done += p.Downloaded
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(done) / float64(total)
+}
+
+// Final is true once nothing more will happen to the job
+func (j *Job) Final() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// Job ids are random and opaque, never anything from a request
+var JOB_ID_RE = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func newJobId() string {
+	return uuid.New().String()
+}
+
+// Whether the id could be a job, checked before it goes near the filesystem
+func ValidJobId(id string) bool {
+	return JOB_ID_RE.MatchString(id)
+}
+
+/*
+Join a file name onto a directory, refusing anything that is not a plain name in it. Every job
+file path, book directory and part file name from an ODM is made or checked here
+*/
+func safeJoin(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// Path of a file of the job in the data directory, such as its .json or .log
+func (q *JobQueue) jobFile(id, ext string) (string, error) {
+	if !ValidJobId(id) {
+		return "", fmt.Errorf("invalid job id %q", id)
+	}
+	return safeJoin(q.dir, id+ext)
+}
+
+// Path of the job log
+func (q *JobQueue) LogFile(j Job) string {
+	path, err := q.jobFile(j.Id, ".log")
+	if err != nil {
+		// Ids are checked when jobs are made and loaded, so this cannot happen
+		panic(err)
+	}
+	return path
+}
+
+/*
+JobQueue runs the jobs in the order they were added, at most workers at once. Every change
+to a job is written to disk first, so a restart picks up where it stopped
+*/
+type JobQueue struct {
+	dir     string
+	workers int
+	run     func(context.Context, *Job) error
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*Job
+	pending []string
+	running map[string]context.CancelFunc
+	events  *EventBus
+}
+
+var (
+	ErrNoJob        = errors.New("no such job")
+	ErrJobCancelled = errors.New("cancelled") // Cancelling a job fails it with this error
+)
+
+// Load the saved jobs from dir, queueing again every job that had not finished
+func NewJobQueue(dir string, workers int, run func(context.Context, *Job) error, events *EventBus) (*JobQueue, error) {
+	q := &JobQueue{
+		dir:     dir,
+		workers: workers,
+		run:     run,
+		events:  events,
+		jobs:    make(map[string]*Job),
+		pending: make([]string, 0),
+		running: make(map[string]context.CancelFunc),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	resume := make([]*Job, 0)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		j := &Job{}
+		if err := json.Unmarshal(data, j); err != nil {
+			log.Println("Skipping invalid job", file, err)
+			continue
+		}
+		q.jobs[j.Id] = j
+		if !j.Final() {
+			resume = append(resume, j)
+		}
+	}
+	sort.Slice(resume, func(i, j int) bool {
+		return resume[i].Created.Before(resume[j].Created)
+	})
+	for _, j := range resume {
+		log.Println("Resuming job", j.Id, "from", j.State)
+		j.State = JobQueued
+		if err := q.save(j); err != nil {
+			return nil, err
+		}
+		q.pending = append(q.pending, j.Id)
+	}
+	return q, nil
+}
+
+// Start the workers
+func (q *JobQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		j := q.jobs[q.pending[0]]
+		q.pending = q.pending[1:]
+		ctx, cancel := context.WithCancel(context.Background())
+		q.running[j.Id] = cancel
+		q.mu.Unlock()
+
+		q.Update(j, func(j *Job) {
+			j.Started = time.Now()
+			j.Error = ""
+		})
+		err := q.run(ctx, j)
+		if ctx.Err() != nil {
+			err = ErrJobCancelled
+		}
+		cancel()
+		q.Update(j, func(j *Job) {
+			delete(q.running, j.Id)
+			j.Finished = time.Now()
+			if err != nil {
+				j.State = JobFailed
+				j.Error = err.Error()
+			} else {
+				j.State = JobDone
+			}
+		})
+	}
+}
+
+// Save a new job and queue it. The id is changed if another job already has it
+func (q *JobQueue) Add(j *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.insert(j, JobQueued); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, j.Id)
+	q.cond.Signal()
+	return nil
+}
+
+// Save a new job that is already done, such as one linked to a book in the library
+func (q *JobQueue) AddDone(j *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.Finished = time.Now()
+	return q.insert(j, JobDone)
+}
+
+// Give the job a new id and save it. Must hold q.mu
+func (q *JobQueue) insert(j *Job, state string) error {
+	j.Id = newJobId()
+	for q.jobs[j.Id] != nil {
+		j.Id = newJobId()
+	}
+	j.State = state
+	j.Created = time.Now()
+	if err := q.save(j); err != nil {
+		return err
+	}
+	q.jobs[j.Id] = j
+	return nil
+}
+
+// The newest job of the owner for the book with the media id
+func (q *JobQueue) FindMedia(mediaId, owner string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var found *Job
+	for _, j := range q.jobs {
+		if j.MediaId == mediaId && j.Owner == owner && j.LinkedTo == "" {
+			if found == nil || j.Created.After(found.Created) {
+				found = j
+			}
+		}
+	}
+	if found == nil {
+		return Job{}, false
+	}
+	return found.copy(), true
+}
+
+/*
+Queue a finished job again with a newly uploaded ODM of the same book, a new loan needs its new
+license. With redownload the parts already downloaded are fetched again
+*/
+func (q *JobQueue) Requeue(id, odm string, redownload bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	if !j.Final() {
+		return fmt.Errorf("job %s is still %s", id, j.State)
+	}
+	j.Odm = odm
+	j.Redownload = redownload
+	j.Returned = false
+	j.State = JobQueued
+	j.Error = ""
+	j.Finished = time.Time{}
+	if err := q.save(j); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, j.Id)
+	q.cond.Signal()
+	return nil
+}
+
+// Get a copy of the job
+func (q *JobQueue) Get(id string) (Job, bool) {
+	if !ValidJobId(id) {
+		return Job{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.copy(), true
+}
+
+// Copies of every job, oldest first
+func (q *JobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j.copy())
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
+
+// Stop a queued or running job, it ends up failed
+func (q *JobQueue) Cancel(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	if cancel, ok := q.running[id]; ok {
+		// The parser cannot be stopped half way, it would leave the book half split
+		if j.State == JobSplitting {
+			return fmt.Errorf("job %s is splitting chapters and cannot be cancelled", id)
+		}
+		cancel()
+		return nil
+	}
+	if j.Final() {
+		return fmt.Errorf("job %s has already finished", id)
+	}
+	for i, p := range q.pending {
+		if p == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	j.State = JobFailed
+	j.Error = ErrJobCancelled.Error()
+	j.Finished = time.Now()
+	return q.save(j)
+}
+
+// Queue a finished job again, parts already downloaded are kept
+func (q *JobQueue) Retry(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	if !j.Final() {
+		return fmt.Errorf("job %s is still %s", id, j.State)
+	}
+	j.State = JobQueued
+	j.Error = ""
+	j.Finished = time.Time{}
+	if err := q.save(j); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, j.Id)
+	q.cond.Signal()
+	return nil
+}
+
+// Forget a finished job, removing its ODM, license and log. The book itself is kept
+func (q *JobQueue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	if !j.Final() {
+		return fmt.Errorf("job %s is still %s, cancel it first", id, j.State)
+	}
+	return q.remove(j)
+}
+
+// Forget the jobs that finished before the time, returning how many there were
+func (q *JobQueue) Prune(before time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, j := range q.jobs {
+		if !j.Final() || j.Finished.IsZero() || !j.Finished.Before(before) {
+			continue
+		}
+		if err := q.remove(j); err != nil {
+			log.Println("Could not remove job", j.Id, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// Remove the files of a finished job, called with the lock held
+func (q *JobQueue) remove(j *Job) error {
+	state, err := q.jobFile(j.Id, ".json")
+	if err != nil {
+		return err
+	}
+	files := []string{q.LogFile(*j), state}
+	// Uploads of the same file share the ODM, only remove it with the last of them
+	shared := false
+	for _, other := range q.jobs {
+		shared = shared || (other != j && other.Odm == j.Odm)
+	}
+	if !shared {
+		files = append(files, j.Odm, j.Odm+".license")
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(q.jobs, j.Id)
+	return nil
+}
+
+// Change the job and save it
+func (q *JobQueue) Update(j *Job, change func(*Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(j)
+	if err := q.save(j); err != nil {
+		log.Println("Could not save job", j.Id, err)
+	}
+}
+
+// Change the job with the id and save it
+func (q *JobQueue) Modify(id string, change func(*Job)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	change(j)
+	return q.save(j)
+}
+
+// Change the job without saving it, for progress that changes too often to write out
+func (q *JobQueue) UpdateProgress(j *Job, change func(*Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(j)
+}
+
+// Move the job on to the next state
+func (q *JobQueue) SetState(j *Job, state string) {
+	q.Update(j, func(j *Job) { j.State = state })
+}
+
+// Write the job with a rename so a crash never leaves half a file, and tell anyone watching
+// it. Must hold q.mu
+func (q *JobQueue) save(j *Job) error {
+	q.events.Publish(jobEvent(EventJob, j.copy()))
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := q.jobFile(j.Id, ".json")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,198 @@
+package godm
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audio files that make up a book in the library, with the type they are served as
+var audioTypes = map[string]string{".mp3": "audio/mpeg", ".m4a": "audio/mp4", ".opus": "audio/ogg"}
+
+// LibraryBook is a book directory in the output tree
+type LibraryBook struct {
+	Id       string    `json:"id"` // Directory of the book, relative to the library root
+	Title    string    `json:"title"`
+	Author   string    `json:"author,omitempty"`
+	Files    int       `json:"files"`
+	Size     int64     `json:"size"`
+	Cover    bool      `json:"cover"`
+	Modified time.Time `json:"modified"`
+
+	Chapters []LibraryChapter `json:"chapters,omitempty"`
+}
+
+// LibraryChapter is an audio file of a book, in the order they are played
+type LibraryChapter struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+/*
+Find the books under root. A book is a directory with audio files in it, other directories
+such as the ones for each user are searched for books. The title and author come from
+metadata.json when the book has one
+*/
+func ScanLibrary(root string) ([]LibraryBook, error) {
+	books := make([]LibraryBook, 0)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return books, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if b, ok := scanBook(root, filepath.ToSlash(rel)); ok {
+			books = append(books, b)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+	return books, nil
+}
+
+func scanBook(root, name string) (LibraryBook, bool) {
+	dir := filepath.Join(root, filepath.FromSlash(name))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return LibraryBook{}, false
+	}
+	b := LibraryBook{Id: name, Title: filepath.Base(dir)}
+	for _, f := range files {
+		switch {
+		case !f.Mode().IsRegular():
+			continue
+		case audioTypes[strings.ToLower(filepath.Ext(f.Name()))] != "":
+			b.Files++
+			b.Size += f.Size()
+			b.Chapters = append(b.Chapters, LibraryChapter{Name: chapterName(f.Name()), File: f.Name(), Size: f.Size()})
+			if f.ModTime().After(b.Modified) {
+				b.Modified = f.ModTime()
+			}
+		case f.Name() == "folder.jpg":
+			b.Cover = true
+		}
+	}
+	if b.Files == 0 {
+		return LibraryBook{}, false
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, sidecarFiles[SidecarJSON])); err == nil {
+		book := Book{Metadata: &Metadata{}}
+		if json.Unmarshal(data, &book) == nil && book.Title != "" {
+			b.Title = book.Title
+			b.Author = book.GetAuthor()
+		}
+	}
+	return b, true
+}
+
+// Name of a chapter from its file, "03 - Chapter 2.mp3" is "Chapter 2"
+func chapterName(file string) string {
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+	if i := strings.Index(name, " - "); i > 0 && strings.Trim(name[:i], "0123456789") == "" {
+		name = name[i+3:]
+	}
+	return name
+}
+
+/*
+Get a book of the library under root by its id. Ids come from users, so only clean relative
+paths to a book directory are accepted
+*/
+func ReadLibraryBook(root, id string) (LibraryBook, error) {
+	if _, err := LibraryBookDir(root, id); err != nil {
+		return LibraryBook{}, err
+	}
+	b, ok := scanBook(root, id)
+	if !ok {
+		return LibraryBook{}, ErrNoBook
+	}
+	return b, nil
+}
+
+var ErrNoBook = errors.New("no such book")
+
+// Directory of the book with the id, which must not leave root
+func LibraryBookDir(root, id string) (string, error) {
+	if id == "" || id == "." || path.IsAbs(id) || path.Clean(id) != id || strings.Contains(id, "\\") {
+		return "", ErrNoBook
+	}
+	for _, part := range strings.Split(id, "/") {
+		if part == ".." {
+			return "", ErrNoBook
+		}
+	}
+	return filepath.Join(root, filepath.FromSlash(id)), nil
+}
+
+// Open a chapter of a book, only the audio files scanned for the book can be opened
+func OpenChapter(root string, b LibraryBook, file string) (*os.File, error) {
+	for _, c := range b.Chapters {
+		if c.File != file {
+			continue
+		}
+		dir, err := LibraryBookDir(root, b.Id)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, c.File)
+		// A link in the book must not lead out of the library
+		if !insideDir(root, name) {
+			return nil, ErrNoBook
+		}
+		return os.Open(name)
+	}
+	return nil, os.ErrNotExist
+}
+
+// Whether the file is inside dir once links are followed
+func insideDir(dir, file string) bool {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realDir, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Find the book directory under root whose manifest is for the ODM id, empty if there is none
+func FindInLibrary(root, odmId string) string {
+	found := ""
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found != "" {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != ManifestName {
+			return nil
+		}
+		if m, err := ReadManifest(path); err == nil && m.OdmId == odmId {
+			found = filepath.Dir(path)
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,210 @@
+package godm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Name of the manifest written into each book directory
+const ManifestName = "godm-manifest.json"
+
+// Manifest records the size and hash of every file in a book so bit rot can be found later
+type Manifest struct {
+	Godm    string         `json:"godm"` // Version of godm that wrote it
+	OdmId   string         `json:"odm_id,omitempty"`
+	Created time.Time      `json:"created"`
+	Files   []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path   string `json:"path"` // Relative to the manifest, with forward slashes
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Hash every file under dir, except the manifest itself
+func NewManifest(dir, odmId string) (*Manifest, error) {
+	m := &Manifest{
+		Godm:    Version(),
+		OdmId:   odmId,
+		Created: time.Now().UTC(),
+		Files:   make([]ManifestFile, 0),
+	}
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == ManifestName || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   info.Size(),
+			Sha256: sum,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+	return m, nil
+}
+
+// Build and save the manifest for a book directory
+func WriteManifest(dir, odmId string) error {
+	m, err := NewManifest(dir, odmId)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestName), data, 0644)
+}
+
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %s", path, err)
+	}
+	return m, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ManifestProblem is a file that no longer matches its manifest
+type ManifestProblem struct {
+	Path   string
+	Reason string
+}
+
+func (p ManifestProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Reason)
+}
+
+// Check every file in the manifest against the files in dir
+func (m *Manifest) Check(dir string) []ManifestProblem {
+	problems := make([]ManifestProblem, 0)
+	for _, f := range m.Files {
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		info, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, ManifestProblem{path, "missing"})
+			continue
+		}
+		if info.Size() != f.Size {
+			problems = append(problems, ManifestProblem{path, fmt.Sprintf("corrupt, size %d expected %d", info.Size(), f.Size)})
+			continue
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			problems = append(problems, ManifestProblem{path, err.Error()})
+			continue
+		}
+		if sum != f.Sha256 {
+			problems = append(problems, ManifestProblem{path, "corrupt, sha256 does not match"})
+		}
+	}
+	return problems
+}
+
+type Verify struct {
+	Path     string `arg:"" help:"Book directory, or with --manifest a whole library" type:"existingdir"`
+	Manifest bool   `short:"m" help:"Check every file against the godm manifests under the path"`
+	Format   string `help:"Format the book was downloaded in, as given to download --format"`
+	Quality  string `help:"Quality the book was downloaded in, as given to download --quality"`
+}
+
+func (v *Verify) Run() error {
+	if !v.Manifest {
+		// Check the parts against the ODM in the book directory
+		odms, err := filepath.Glob(filepath.Join(v.Path, "*.odm"))
+		if err != nil {
+			return err
+		}
+		if len(odms) == 0 {
+			return fmt.Errorf("no ODM file in %s, use --manifest to check against a manifest", v.Path)
+		}
+		if err := verifyODM(odms[0], v.Format, v.Quality, v.Path); err != nil {
+			return err
+		}
+		fmt.Println("All parts present")
+		return nil
+	}
+
+	books, failed := 0, 0
+	err := filepath.Walk(v.Path, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != ManifestName {
+			return nil
+		}
+		books++
+		dir := filepath.Dir(path)
+		m, err := ReadManifest(path)
+		if err != nil {
+			fmt.Println("FAIL", dir, err)
+			failed++
+			return nil
+		}
+		problems := m.Check(dir)
+		if len(problems) == 0 {
+			fmt.Println("OK  ", dir)
+			return nil
+		}
+		failed++
+		fmt.Println("FAIL", dir)
+		for _, p := range problems {
+			fmt.Println("    ", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if books == 0 {
+		return fmt.Errorf("no %s found under %s", ManifestName, v.Path)
+	}
+	fmt.Printf("%d books checked, %d with problems\n", books, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d books failed verification", failed)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package godm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mikkyang/id3-go"
+	v2 "github.com/mikkyang/id3-go/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Description of the TXXX frame overdrive stores the chapter markers in
+const MediaMarkersDescription = "OverDrive MediaMarkers"
+
+var (
+	ErrNoTag        = errors.New("no ID3v2 tag")
+	ErrNoMarkers    = errors.New("no OverDrive MediaMarkers frame")
+	ErrEmptyMarkers = errors.New("OverDrive MediaMarkers frame has no markers")
+)
+
+// MarkerError is returned when the markers of a part exist but cannot be read
+type MarkerError struct {
+	Path string
+	Err  error
+}
+
+func (e *MarkerError) Error() string {
+	return fmt.Sprintf("invalid OverDrive MediaMarkers in %s: %s", e.Path, e.Err)
+}
+
+func (e *MarkerError) Unwrap() error {
+	return e.Err
+}
+
+// Encodings the markers XML has been seen in. The frame encoding byte is not always correct
+var markerEncodings = []encoding.Encoding{
+	nil, // UTF-8 and ISO-8859-1, which are the same for the XML tags we search for
+	unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+/*
+Read the OverDrive chapter markers from a part. The tag is parsed with id3 first, if that
+fails (ID3v2.4 sizes, unknown frames and bad encodings all stop the id3 parser early) the raw
+tag is searched for the markers instead.
+
+ErrNoTag or ErrNoMarkers are returned if the file has no markers, a *MarkerError if they
+cannot be parsed
+*/
+func ReadMarkers(path string) ([]*Marker, error) {
+	markers, err := readTagMarkers(path)
+	if err == nil {
+		return markers, nil
+	}
+	if rawMarkers, rawErr := readRawMarkers(path); rawErr == nil {
+		return rawMarkers, nil
+	} else if errors.Is(err, ErrNoMarkers) || errors.Is(err, ErrNoTag) {
+		// The raw search may have found something the id3 parser could not
+		err = rawErr
+	}
+	return nil, err
+}
+
+func readTagMarkers(path string) ([]*Marker, error) {
+	f, err := OpenTag(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ExtractMarkers(f.Tagger, path)
+}
+
+/*
+Open the ID3 tag of a file. id3 does not check the sizes in corrupt tags, it can panic or
+allocate whatever a frame claims, so the frame sizes are checked first
+*/
+func OpenTag(path string) (f *id3.File, err error) {
+	if err := checkFrameSizes(path); err != nil {
+		return nil, &MarkerError{Path: path, Err: err}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, &MarkerError{Path: path, Err: fmt.Errorf("corrupt tag: %v", r)}
+		}
+	}()
+	return id3.Open(path)
+}
+
+// Check every frame of the ID3v2 tag fits in the tag. Files without a tag are fine
+func checkFrameSizes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, v2.HeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+	tag, err := ioutil.ReadAll(io.LimitReader(f, syncsafe(header[6:10])))
+	if err != nil {
+		return err
+	}
+	// ID3v2.2 frames have a 3 byte id and size, later versions 4 bytes of each and 2 of flags
+	idSize, headerSize := 4, v2.FrameHeaderSize
+	if header[3] == 2 {
+		idSize, headerSize = 3, v2.V22FrameHeaderSize
+	}
+	for i := 0; i+headerSize <= len(tag) && tag[i] != 0; {
+		// ID3v2.4 frame sizes are syncsafe like the tag size
+		size := 0
+		for _, b := range tag[i+idSize : i+2*idSize] {
+			if header[3] == 4 {
+				size = size<<7 | int(b&0x7f)
+			} else {
+				size = size<<8 | int(b)
+			}
+		}
+		if size > len(tag)-i-headerSize {
+			return fmt.Errorf("corrupt tag: frame %q of %d bytes is past the end of the tag", tag[i:i+idSize], size)
+		}
+		i += headerSize + size
+	}
+	return nil
+}
+
+// Decode a syncsafe integer, 7 bits in each byte
+func syncsafe(b []byte) int64 {
+	size := int64(0)
+	for _, c := range b {
+		size = size<<7 | int64(c&0x7f)
+	}
+	return size
+}
+
+/*
+Find the markers in a parsed tag. Every TXXX frame (TXX in ID3v2.2) is checked for the
+OverDrive description, not only the first one
+*/
+func ExtractMarkers(tag id3.Tagger, path string) ([]*Marker, error) {
+	if _, ok := tag.(*v2.Tag); !ok {
+		return nil, ErrNoTag
+	}
+	frames := make([]v2.Framer, 0)
+	frames = append(frames, tag.Frames("TXXX")...)
+	frames = append(frames, tag.Frames("TXX")...)
+
+	var lastErr error = ErrNoMarkers
+	for _, frame := range frames {
+		desc, text := splitDescFrame(frame)
+		if !strings.Contains(cleanText(desc), MediaMarkersDescription) {
+			continue
+		}
+		markers, err := ParseMarkers(text)
+		if err == nil {
+			return markers, nil
+		}
+		lastErr = &MarkerError{Path: path, Err: err}
+	}
+	return nil, lastErr
+}
+
+/*
+Search the raw ID3v2 tag of a file for the markers XML. Only the tag is read, it is found
+by the syncsafe size in the header which is the same for every ID3v2 version
+*/
+func readRawMarkers(path string) ([]*Marker, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, v2.HeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:3]) != "ID3" {
+		return nil, ErrNoTag
+	}
+	tag, err := ioutil.ReadAll(io.LimitReader(f, syncsafe(header[6:10])))
+	if err != nil {
+		return nil, err
+	}
+
+	text, ok := findMarkersXML(tag)
+	if !ok {
+		return nil, ErrNoMarkers
+	}
+	markers, err := ParseMarkers(text)
+	if err != nil {
+		return nil, &MarkerError{Path: path, Err: err}
+	}
+	return markers, nil
+}
+
+// Find the <Markers> element in raw bytes, trying each encoding the XML may be stored in
+func findMarkersXML(data []byte) (string, bool) {
+	for _, enc := range markerEncodings {
+		start, end := []byte("<Markers>"), []byte("</Markers>")
+		if enc != nil {
+			start, _ = enc.NewEncoder().Bytes(start)
+			end, _ = enc.NewEncoder().Bytes(end)
+		}
+		i := bytes.Index(data, start)
+		if i < 0 {
+			continue
+		}
+		j := bytes.Index(data[i:], end)
+		if j < 0 {
+			continue
+		}
+		raw := data[i : i+j+len(end)]
+		if enc == nil {
+			return string(raw), true
+		}
+		decoded, err := enc.NewDecoder().Bytes(raw)
+		if err != nil {
+			continue
+		}
+		return string(decoded), true
+	}
+	return "", false
+}
+
+/*
+Parse the markers XML. Leading junk, BOMs and null bytes are removed and the XML is parsed
+leniently as overdrive does not always escape the chapter names
+*/
+func ParseMarkers(text string) ([]*Marker, error) {
+	text = cleanText(text)
+	if i := strings.Index(text, "<Markers"); i > 0 {
+		text = text[i:]
+	}
+	if text == "" {
+		return nil, ErrEmptyMarkers
+	}
+
+	markers := &Markers{}
+	d := xml.NewDecoder(strings.NewReader(text))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := d.Decode(markers); err != nil {
+		return nil, err
+	}
+
+	valid := make([]*Marker, 0, len(markers.Markers))
+	for _, m := range markers.Markers {
+		if strings.TrimSpace(m.Time) == "" {
+			continue
+		}
+		start, err := ParseMarkerTime(cleanText(m.Time))
+		if err != nil {
+			return nil, fmt.Errorf("marker %q: %w", cleanText(m.Name), err)
+		}
+		valid = append(valid, &Marker{
+			Name:  cleanText(m.Name),
+			Start: start,
+		})
+	}
+	if len(valid) == 0 {
+		return nil, ErrEmptyMarkers
+	}
+	return valid, nil
+}
+
+// Get the text of a frame, without the description for TXXX and COMM frames
+func FrameText(tag id3.Tagger, ids ...string) string {
+	for _, id := range ids {
+		for _, frame := range tag.Frames(id) {
+			_, text := splitDescFrame(frame)
+			if text = cleanText(text); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// Split a frame into its description and text
+func splitDescFrame(frame v2.Framer) (string, string) {
+	switch f := frame.(type) {
+	case *v2.UnsynchTextFrame:
+		return f.Description(), f.Text()
+	case *v2.DescTextFrame:
+		return f.Description(), f.Text()
+	case *v2.TextFrame:
+		return "", f.Text()
+	case nil:
+		return "", ""
+	}
+	parts := strings.SplitN(frame.String(), ":", 2)
+	if len(parts) < 2 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// Remove null bytes and BOMs that some taggers leave in text frames
+func cleanText(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+	s = strings.ReplaceAll(s, "\ufeff", "")
+	s = strings.ReplaceAll(s, "\ufffe", "")
+	return strings.TrimSpace(s)
+}
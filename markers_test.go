@@ -0,0 +1,281 @@
+package godm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v2 "github.com/mikkyang/id3-go/v2"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const testMarkers = `<Markers><Marker><Name>Opening</Name><Time>0:00.000</Time></Marker>` +
+	`<Marker><Name>Chapter 1</Name><Time>1:02.500</Time></Marker></Markers>`
+
+// Write the bytes to a file in a temporary directory
+func writeTestFile(t testing.TB, data []byte) string {
+	path := filepath.Join(t.TempDir(), "part.mp3")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A raw ID3v2.3 header for a tag of the size, which is syncsafe
+func id3Header(size int) []byte {
+	return id3VersionHeader(3, size)
+}
+
+func id3VersionHeader(version byte, size int) []byte {
+	return append([]byte{'I', 'D', '3', version, 0, 0}, syncsafeBytes(size)...)
+}
+
+func syncsafeBytes(size int) []byte {
+	return []byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+}
+
+func checkMarkers(t *testing.T, markers []*Marker) {
+	t.Helper()
+	want := []Marker{{Name: "Opening"}, {Name: "Chapter 1", Start: time.Minute + 2500*time.Millisecond}}
+	if len(markers) != len(want) {
+		t.Fatalf("got %d markers, want %d", len(markers), len(want))
+	}
+	for i, m := range markers {
+		if m.Name != want[i].Name || m.Start != want[i].Start {
+			t.Errorf("marker %d is %q at %v, want %q at %v", i, m.Name, m.Start, want[i].Name, want[i].Start)
+		}
+	}
+}
+
+func TestParseMarkers(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		err  bool
+	}{
+		{"plain", testMarkers, false},
+		{"junk before", "\x00\ufeffjunk" + testMarkers, false},
+		{"null bytes", "\x00" + testMarkers + "\x00\x00", false},
+		{"unescaped name", `<Markers><Marker><Name>A & B</Name><Time>0:00</Time></Marker></Markers>`, false},
+		{"empty", "", true},
+		{"no markers", "<Markers></Markers>", true},
+		{"bad time", `<Markers><Marker><Name>A</Name><Time>x:00</Time></Marker></Markers>`, true},
+		{"negative time", `<Markers><Marker><Name>A</Name><Time>-1</Time></Marker></Markers>`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			markers, err := ParseMarkers(test.text)
+			if test.err != (err != nil) {
+				t.Fatalf("got %d markers and error %v", len(markers), err)
+			}
+		})
+	}
+	markers, err := ParseMarkers("junk" + testMarkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMarkers(t, markers)
+}
+
+func TestExtractMarkers(t *testing.T) {
+	txxx := v2.V23FrameTypeMap["TXXX"]
+	tests := []struct {
+		name    string
+		version byte
+		frames  []v2.Framer
+		err     error
+	}{
+		{"markers", 3, []v2.Framer{v2.NewDescTextFrame(txxx, MediaMarkersDescription, testMarkers)}, nil},
+		{"markers not first", 3, []v2.Framer{
+			v2.NewDescTextFrame(txxx, "Other", "text"),
+			v2.NewDescTextFrame(txxx, "Another", testMarkers),
+			v2.NewDescTextFrame(txxx, MediaMarkersDescription, testMarkers),
+		}, nil},
+		{"ID3v2.2", 2, []v2.Framer{v2.NewDescTextFrame(v2.V22FrameTypeMap["TXX"], MediaMarkersDescription, testMarkers)}, nil},
+		{"TXXX without description", 3, []v2.Framer{v2.NewDataFrame(txxx, []byte(testMarkers))}, ErrNoMarkers},
+		{"no TXXX", 3, nil, ErrNoMarkers},
+		{"empty markers", 3, []v2.Framer{v2.NewDescTextFrame(txxx, MediaMarkersDescription, "<Markers></Markers>")}, ErrEmptyMarkers},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag := v2.NewTag(test.version)
+			tag.AddFrames(test.frames...)
+			markers, err := ExtractMarkers(tag, "part.mp3")
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMarkers(t, markers)
+		})
+	}
+}
+
+func TestFindMarkersXML(t *testing.T) {
+	for _, enc := range []string{"UTF-8", "UTF-16LE", "UTF-16BE"} {
+		t.Run(enc, func(t *testing.T) {
+			data := []byte(testMarkers)
+			switch enc {
+			case "UTF-16LE":
+				data, _ = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes(data)
+			case "UTF-16BE":
+				data, _ = unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewEncoder().Bytes(data)
+			}
+			text, ok := findMarkersXML(append([]byte("TXXX\x00\x01junk"), data...))
+			if !ok {
+				t.Fatal("markers not found")
+			}
+			markers, err := ParseMarkers(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMarkers(t, markers)
+		})
+	}
+	if _, ok := findMarkersXML([]byte("<Markers> with no end")); ok {
+		t.Error("found markers without an end tag")
+	}
+}
+
+func TestReadRawMarkers(t *testing.T) {
+	body := append([]byte("TXXX junk "), testMarkers...)
+	badSize := id3Header(len(body))
+	// The top bit of each size byte must be 0, it is ignored rather than trusted
+	for i := 6; i < 10; i++ {
+		badSize[i] |= 0x80
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"tag", append(id3Header(len(body)), body...), nil},
+		{"size not syncsafe", append(badSize, body...), nil},
+		{"size past the end", append(id3Header(1<<27), body...), nil},
+		{"size too small", append(id3Header(4), body...), ErrNoMarkers},
+		{"no tag", body, ErrNoTag},
+		{"short header", []byte("ID3"), ErrNoTag},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			markers, err := readRawMarkers(writeTestFile(t, test.data))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMarkers(t, markers)
+		})
+	}
+}
+
+func TestReadMarkers(t *testing.T) {
+	tag := v2.NewTag(3)
+	tag.AddFrames(
+		v2.NewDescTextFrame(v2.V23FrameTypeMap["TXXX"], "Other", "text"),
+		v2.NewDescTextFrame(v2.V23FrameTypeMap["TXXX"], MediaMarkersDescription, testMarkers),
+	)
+	markers, err := ReadMarkers(writeTestFile(t, tag.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMarkers(t, markers)
+}
+
+func TestOpenTagFrameTooBig(t *testing.T) {
+	// A frame claiming 2GB must not be allocated
+	data := append(id3Header(64), "TXXX\x7f\xff\xff\xff\x00\x00"...)
+	data = append(data, make([]byte, 64)...)
+	var err *MarkerError
+	if _, e := OpenTag(writeTestFile(t, data)); !errors.As(e, &err) {
+		t.Fatalf("got error %v, want a MarkerError", e)
+	}
+}
+
+func TestCheckFrameSizes(t *testing.T) {
+	// A frame with a body of the size, its header size written by size()
+	frame := func(id string, body int, size func(int) []byte) []byte {
+		f := append([]byte(id), size(body)...)
+		if len(id) == 4 {
+			f = append(f, 0, 0)
+		}
+		return append(f, make([]byte, body)...)
+	}
+	plain := func(n int) []byte { return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)} }
+	tag := func(version byte, frames ...[]byte) []byte {
+		var body []byte
+		for _, f := range frames {
+			body = append(body, f...)
+		}
+		body = append(body, make([]byte, 16)...) // Padding
+		return append(id3VersionHeader(version, len(body)), body...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"ID3v2.3", tag(3, frame("COMM", 10, plain), frame("APIC", 300, plain)), true},
+		{"ID3v2.4 syncsafe sizes", tag(4, frame("COMM", 10, syncsafeBytes), frame("APIC", 300, syncsafeBytes)), true},
+		{"ID3v2.2", tag(2, frame("COM", 10, func(n int) []byte { return plain(n)[1:] }), frame("PIC", 300, func(n int) []byte { return plain(n)[1:] })), true},
+		{"ID3v2.3 frame too big", tag(3, append(frame("APIC", 0, plain)[:4], 0, 0, 0x10, 0, 0, 0)), false},
+		{"ID3v2.4 frame too big", tag(4, append(frame("APIC", 0, plain)[:4], 0, 0, 0x7f, 0, 0, 0)), false},
+		{"no tag", []byte("not a tag"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkFrameSizes(writeTestFile(t, test.data))
+			if test.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func FuzzParseMarkers(f *testing.F) {
+	f.Add(testMarkers)
+	f.Add("\x00\ufeff" + testMarkers)
+	f.Add(`<Markers><Marker><Name>A & B</Name><Time>1:2:3:4</Time></Marker>`)
+	f.Add("<Markers><Marker><Time>99999999999999999999</Time></Marker></Markers>")
+	f.Fuzz(func(t *testing.T, text string) {
+		markers, err := ParseMarkers(text)
+		if err == nil && len(markers) == 0 {
+			t.Error("no markers and no error")
+		}
+		for _, m := range markers {
+			if m.Start < 0 {
+				t.Errorf("marker %q starts at %v", m.Name, m.Start)
+			}
+		}
+	})
+}
+
+// Corrupt tags must give an error, never a panic
+func FuzzExtractMarkers(f *testing.F) {
+	tag := v2.NewTag(3)
+	tag.AddFrames(v2.NewDescTextFrame(v2.V23FrameTypeMap["TXXX"], MediaMarkersDescription, testMarkers))
+	f.Add(tag.Bytes())
+	tag = v2.NewTag(2)
+	tag.AddFrames(v2.NewDescTextFrame(v2.V22FrameTypeMap["TXX"], MediaMarkersDescription, testMarkers))
+	f.Add(tag.Bytes())
+	f.Add(append(id3Header(1<<27), testMarkers...))
+	f.Add([]byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7fTXXX\xff\xff\xff\xff\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := writeTestFile(t, data)
+		if file, err := OpenTag(path); err == nil {
+			ExtractMarkers(file.Tagger, path)
+			file.Close()
+		}
+		readRawMarkers(path)
+	})
+}
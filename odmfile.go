@@ -2,6 +2,7 @@ package godm
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/xml"
@@ -36,14 +37,30 @@ type LicenseFile struct {
 type Metadata struct {
 	ContentType  string
 	Title        string
+	SubTitle     string
+	Series       string
+	Edition      string
+	Publisher    string
+	PublishDate  string
+	Description  string
 	CoverUrl     string
 	ThumbnailUrl string
 	Creators     struct {
 		Creators []struct {
-			Role string `xml:"role,attr"`
-			Name string `xml:",innerxml"`
+			Role   string `xml:"role,attr"`
+			FileAs string `xml:"file-as,attr"`
+			Name   string `xml:",innerxml"`
 		} `xml:"Creator"`
 	}
+	Subjects struct {
+		Subjects []string `xml:"Subject"`
+	}
+	Languages struct {
+		Languages []struct {
+			Code string `xml:"code,attr"`
+			Name string `xml:",chardata"`
+		} `xml:"Language"`
+	}
 }
 
 func (m Metadata) GetAuthor() string {
@@ -58,6 +75,21 @@ func (m Metadata) GetAuthor() string {
 	return m.Creators.Creators[0].Name
 }
 
+// Get every creator with the role, e.g. "Narrator"
+func (m Metadata) GetCreators(role string) []string {
+	names := make([]string, 0)
+	for _, c := range m.Creators.Creators {
+		if strings.EqualFold(c.Role, role) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+func (m Metadata) GetNarrator() string {
+	return strings.Join(m.GetCreators("Narrator"), ", ")
+}
+
 func (m Metadata) GetFolderName() string {
 	return strings.ReplaceAll(fmt.Sprintf("%s_%s", m.GetAuthor(), m.Title), " ", "")
 }
@@ -69,6 +101,22 @@ type Part struct {
 	FileName string `xml:"filename,attr"`
 }
 
+// Name the part is saved as, the last section of the filename from overdrive
+func (p Part) LocalName() string {
+	filenameParts := strings.Split(p.FileName, "-")
+	return filenameParts[len(filenameParts)-1]
+}
+
+// Check every part is saved as a plain file name in the book directory, they come from the ODM
+func (f Format) checkPartNames() error {
+	for _, p := range f.Parts.Part {
+		if _, err := safeJoin(".", p.LocalName()); err != nil {
+			return fmt.Errorf("part %s: %s", p.Number, err)
+		}
+	}
+	return nil
+}
+
 type Parts struct {
 	Count int `xml:"count,attr"`
 	Part  []Part
@@ -80,6 +128,7 @@ type Formats struct {
 
 type Format struct {
 	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
 	Quality struct {
 		Level string `xml:"level,attr"`
 	}
@@ -92,6 +141,25 @@ type Format struct {
 	Parts Parts
 }
 
+// Total size of all the parts in bytes
+func (f Format) Size() int64 {
+	var size int64
+	for _, p := range f.Parts.Part {
+		size += int64(p.FileSize)
+	}
+	return size
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%s (%s, %s quality)", f.Name, f.Type, f.Quality.Level)
+}
+
+// Whether the format matches a name like "mp3", checked against the name and type
+func (f Format) Matches(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(strings.ToLower(f.Name), name) || strings.Contains(strings.ToLower(f.Type), name)
+}
+
 type OverDriveMedia struct {
 	ClientID string
 	Id       string `xml:"id,attr"`
@@ -109,6 +177,8 @@ type OverDriveMedia struct {
 
 	data     []byte
 	filename string
+	selected *Format
+	limiter  *RateLimiter
 }
 
 func NewODMFile(filename string) (*OverDriveMedia, error) {
@@ -210,30 +280,63 @@ func (o *OverDriveMedia) getDownloadUrl(format Format) string {
 	return ""
 }
 
-/* Some files might have more than one format, if so, choose "High" */
-func (o *OverDriveMedia) chooseBestFormat() Format {
-	if len(o.Formats.Formats) == 1 {
-		return o.Formats.Formats[0]
-	}
+// Ranking of the quality levels, unknown levels rank below Low
+var QualityLevels = map[string]int{
+	"low":    1,
+	"medium": 2,
+	"high":   3,
+}
 
-	quality := map[string]int{
-		"Low":    0,
-		"Medium": 1,
-		"High":   2,
-	}
-	var highest *Format
-	for _, format := range o.Formats.Formats {
-		if highest == nil {
-			highest = &format
+/*
+Find the format to download. name matches the format name or type (e.g. "mp3") and quality the
+level (low, medium or high), either can be empty to allow any. Of the matching formats the
+highest quality wins, ties go to the first one in the ODM so the choice is always the same
+*/
+func (o *OverDriveMedia) FindFormat(name, quality string) (Format, error) {
+	best := -1
+	for i, format := range o.Formats.Formats {
+		if name != "" && !format.Matches(name) {
 			continue
 		}
-		if quality[format.Quality.Level] > quality[highest.Quality.Level] {
-			highest = &format
+		if quality != "" && !strings.EqualFold(format.Quality.Level, quality) {
 			continue
 		}
+		if best == -1 || QualityLevels[strings.ToLower(format.Quality.Level)] > QualityLevels[strings.ToLower(o.Formats.Formats[best].Quality.Level)] {
+			best = i
+		}
+	}
+	if best == -1 {
+		available := make([]string, 0, len(o.Formats.Formats))
+		for _, format := range o.Formats.Formats {
+			available = append(available, format.String())
+		}
+		return Format{}, fmt.Errorf("no format matching %q with quality %q, available: %s", name, quality, strings.Join(available, ", "))
+	}
+	return o.Formats.Formats[best], nil
+}
+
+// Limit the speed of every download from this ODM, nil for no limit
+func (o *OverDriveMedia) SetLimiter(l *RateLimiter) {
+	o.limiter = l
+}
+
+// Choose the format used for all downloads from this ODM, see FindFormat
+func (o *OverDriveMedia) SelectFormat(name, quality string) error {
+	format, err := o.FindFormat(name, quality)
+	if err != nil {
+		return err
+	}
+	o.selected = &format
+	return nil
+}
 
+/* Some files might have more than one format, use the selected one or the highest quality */
+func (o *OverDriveMedia) chooseBestFormat() Format {
+	if o.selected != nil {
+		return *o.selected
 	}
-	return *highest
+	format, _ := o.FindFormat("", "")
+	return format
 }
 
 func (o *OverDriveMedia) Return() error {
@@ -250,10 +353,16 @@ func (o *OverDriveMedia) Return() error {
 }
 
 func (o *OverDriveMedia) DownloadPart(p Part, outfile string) error {
+	return o.DownloadPartContext(context.Background(), p, outfile, nil)
+}
+
+// Download a part, stopping when ctx is cancelled. progress is called with the bytes saved so far
+func (o *OverDriveMedia) DownloadPartContext(ctx context.Context, p Part, outfile string, progress func(int64)) error {
 	outf, err := os.Create(outfile)
 	if err != nil {
 		return err
 	}
+	defer outf.Close()
 	license, err := o.GetLicense()
 	if err != nil {
 		return fmt.Errorf("could not get license")
@@ -263,7 +372,7 @@ func (o *OverDriveMedia) DownloadPart(p Part, outfile string) error {
 	if url == "" {
 		return fmt.Errorf("could not get download url")
 	}
-	r, err := http.NewRequest("GET", url+"/"+p.FileName, nil)
+	r, err := http.NewRequestWithContext(ctx, "GET", url+"/"+p.FileName, nil)
 	if err != nil {
 		return err
 	}
@@ -275,18 +384,36 @@ func (o *OverDriveMedia) DownloadPart(p Part, outfile string) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("invalid status code received: %d", resp.StatusCode)
 	}
-	_, err = io.Copy(outf, resp.Body)
+	var w io.Writer = outf
+	if progress != nil {
+		w = &progressWriter{w: outf, progress: progress}
+	}
+	_, err = io.Copy(w, o.limiter.Reader(resp.Body))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+type progressWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.progress(p.n)
+	return n, err
+}
+
 /* Download all the parts */
-func (o *OverDriveMedia) Download(outdir string, threads int, verbose bool) error {
+func (o *OverDriveMedia) Download(outdir string, threads int, verbose, coverFromParts bool) error {
 	// Make sure we have the license
 	license, err := o.GetLicense()
 	if err != nil {
@@ -299,36 +426,54 @@ func (o *OverDriveMedia) Download(outdir string, threads int, verbose bool) erro
 	}
 
 	format := o.chooseBestFormat()
+	if err := format.checkPartNames(); err != nil {
+		return err
+	}
 	url := o.getDownloadUrl(format)
 	if url == "" {
 		return fmt.Errorf("could not get download url")
 	}
 
+	odmCopy := filepath.Join(outdir, filepath.Base(o.filename))
+	f, err := os.Create(odmCopy)
+	if err != nil {
+		return err
+	}
+	f.Write(o.data)
+	f.Close()
+	// The license goes with the ODM so the zip of the originals can be downloaded again
+	if err := ioutil.WriteFile(odmCopy+".license", []byte(license), 0644); err != nil {
+		return err
+	}
+
 	dataChan := make(chan data)
 	errChan := make(chan error)
 	wg := &sync.WaitGroup{}
 	for i := 0; i < threads; i++ {
-		go worker(wg, dataChan, errChan, verbose)
+		go worker(wg, dataChan, errChan, verbose, o.limiter)
 		wg.Add(1)
 	}
-	f, err := os.Create(filepath.Join(outdir, o.filename))
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	f.Write(o.data)
+	// Collect the worker errors so a failed part cannot block the other workers
+	errs := make([]string, 0)
+	errDone := make(chan bool)
+	go func() {
+		for err := range errChan {
+			log.Println("Part failed:", err)
+			errs = append(errs, err.Error())
+		}
+		errDone <- true
+	}()
 
 	for _, part := range format.Parts.Part {
 		r, err := http.NewRequest("GET", url+"/"+part.FileName, nil)
 		if err != nil {
-			return err
+			errChan <- err
+			continue
 		}
 		r.Header.Set("User-Agent", UserAgent)
 		r.Header.Set("ClientID", o.ClientID)
 		r.Header.Set("License", license)
-		filenameParts := strings.Split(part.FileName, "-")
-		filename := filenameParts[len(filenameParts)-1]
-		filename = filepath.Join(outdir, filename)
+		filename := filepath.Join(outdir, part.LocalName())
 		if s, err := os.Stat(filename); err == nil {
 			if s.Size() == int64(part.FileSize) {
 				continue
@@ -341,21 +486,23 @@ func (o *OverDriveMedia) Download(outdir string, threads int, verbose bool) erro
 		}
 	}
 
-	albumArt := filepath.Join(outdir, "folder.jpg")
-	if i, err := os.Stat(albumArt); err == nil && i.Size() != 0 {
-		// Already have it
-	} else {
-		r, err := http.NewRequest("GET", md.CoverUrl, nil)
-		if err != nil {
-			return err
-		}
-		dataChan <- data{
-			f: albumArt,
-			r: r,
-		}
-	}
-
 	close(dataChan)
 	wg.Wait()
+	close(errChan)
+	<-errDone
+	if len(errs) != 0 {
+		return fmt.Errorf("%d parts failed: %s", len(errs), strings.Join(errs, "; "))
+	}
+
+	// Get the cover once the parts are here, they may have one embedded
+	c, err := o.SaveCover(outdir, coverFromParts)
+	if err != nil {
+		log.Println("Could not save cover:", err)
+	} else if verbose {
+		log.Println("Saved cover", c)
+	}
+	if err := WriteManifest(outdir, o.Id); err != nil {
+		log.Println("Could not write manifest:", err)
+	}
 	return nil
 }
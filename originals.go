@@ -0,0 +1,218 @@
+package godm
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What ParseChapters does with the original parts once every chapter is saved
+const (
+	OriginalsKeep   = "keep"   // Leave the parts where they are
+	OriginalsDelete = "delete" // Delete the parts
+	OriginalsZip    = "zip"    // Zip the parts, ODM, license and description, then delete the parts
+	OriginalsMove   = "move"   // Move the parts to <archive>/<book>/
+	OriginalsLink   = "link"   // Hardlink the parts into <archive>/<book>/ and keep them in place
+)
+
+func (p *ParseChapters) originalsMode() string {
+	if p.Originals != "" && p.Originals != OriginalsKeep {
+		return p.Originals
+	}
+	// --delete has always meant zip them up first
+	if p.Delete {
+		return OriginalsZip
+	}
+	return OriginalsKeep
+}
+
+// Name of the book, from the directory the parts are in
+func (p *ParseChapters) bookName() string {
+	_, name := filepath.Split(strings.TrimRight(p.Directory, "/"))
+	return name
+}
+
+// Check the originals can be handled before any work is done
+func (p *ParseChapters) validateOriginals() error {
+	switch p.originalsMode() {
+	case OriginalsMove, OriginalsLink:
+		// The parent of the book would put the parts straight back into the book
+		if p.ArchiveDir == "" {
+			return fmt.Errorf("--archive-dir is required to %s the original parts", p.originalsMode())
+		}
+	}
+	if p.ZipLevel < flate.DefaultCompression || p.ZipLevel > flate.BestCompression {
+		return fmt.Errorf("--zip-level must be from -1 to 9, not %d", p.ZipLevel)
+	}
+	return nil
+}
+
+func (p *ParseChapters) archiveDir() string {
+	if p.ArchiveDir != "" {
+		return p.ArchiveDir
+	}
+	return filepath.Join(p.Outdir, "..")
+}
+
+/*
+Files needed to rebuild the book from the parts: the ODM, its license and the description.
+Only the ones that exist are returned
+*/
+func (p *ParseChapters) bookFiles() []string {
+	files := make([]string, 0, 3)
+	candidates := []string{filepath.Join(p.Outdir, "about.html")}
+	if p.Odm != "" {
+		candidates = append(candidates, p.Odm, p.Odm+".license")
+	}
+	for _, f := range candidates {
+		if i, err := os.Stat(f); err == nil && !i.IsDir() {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Keep, delete, zip, move or link the original parts
+func (p *ParseChapters) handleOriginals(sourceFiles []string) error {
+	switch mode := p.originalsMode(); mode {
+	case OriginalsKeep:
+		return nil
+	case OriginalsDelete:
+		if err := removeFiles(sourceFiles); err != nil {
+			fmt.Fprintf(p.logfile, "%+v ERR: Could not delete file: %s\n", time.Now(), err)
+			return err
+		}
+		fmt.Fprintf(p.logfile, "%+v Deleted original files\n", time.Now())
+	case OriginalsZip:
+		file := filepath.Join(p.archiveDir(), p.bookName()+".zip")
+		if err := os.MkdirAll(p.archiveDir(), 0755); err != nil {
+			return err
+		}
+		if err := zipFiles(file, append(sourceFiles, p.bookFiles()...), p.ZipLevel); err != nil {
+			fmt.Fprintf(p.logfile, "%+v ERR: Could not create output zipfile: %s: %s\n", time.Now(), file, err)
+			os.Remove(file)
+			return err
+		}
+		// Only remove the parts once they are all safely in the zip
+		if err := removeFiles(sourceFiles); err != nil {
+			fmt.Fprintf(p.logfile, "%+v ERR: Could not delete file: %s\n", time.Now(), err)
+			return err
+		}
+		fmt.Fprintf(p.logfile, "%+v Saved original files to %s\n", time.Now(), file)
+	case OriginalsMove, OriginalsLink:
+		dir := filepath.Join(p.archiveDir(), p.bookName())
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(p.logfile, "%+v ERR: Could not create archive directory: %s: %s\n", time.Now(), dir, err)
+			return err
+		}
+		for _, sourceFile := range sourceFiles {
+			dest := filepath.Join(dir, filepath.Base(sourceFile))
+			var err error
+			if mode == OriginalsMove {
+				err = moveFile(sourceFile, dest)
+			} else {
+				err = os.Link(sourceFile, dest)
+			}
+			if err != nil {
+				fmt.Fprintf(p.logfile, "%+v ERR: Could not %s file: %s: %s\n", time.Now(), mode, sourceFile, err)
+				return err
+			}
+		}
+		if mode == OriginalsMove {
+			fmt.Fprintf(p.logfile, "%+v Moved original files to %s\n", time.Now(), dir)
+		} else {
+			fmt.Fprintf(p.logfile, "%+v Linked original files into %s\n", time.Now(), dir)
+		}
+	default:
+		return fmt.Errorf("unknown originals mode %q", mode)
+	}
+	return nil
+}
+
+func removeFiles(files []string) error {
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename a file, copying it if the destination is on another filesystem
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dest string) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
+
+// Write all the files into a new zipfile with the given flate level, 0 stores them uncompressed
+func zipFiles(file string, sourceFiles []string, level int) error {
+	of, err := os.Create(file) // Output zipfile
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+	zf := zip.NewWriter(of) // Output zip writer
+	zf.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	method := zip.Deflate
+	if level == flate.NoCompression {
+		method = zip.Store
+	}
+	for _, sourceFile := range sourceFiles {
+		info, err := os.Stat(sourceFile)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Method = method
+		f, err := zf.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		sf, err := os.Open(sourceFile)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, sf)
+		sf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := zf.Close(); err != nil {
+		return err
+	}
+	return of.Close()
+}
@@ -1,8 +1,7 @@
 package godm
 
 import (
-	"archive/zip"
-	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,29 +10,64 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/mikkyang/id3-go"
-	v2 "github.com/mikkyang/id3-go/v2"
 )
 
 // Remove timestamps from the title as overdrive does this sometimes. e.g. Chapter 7 (00:00)
 var TITLE_RE = regexp.MustCompile(`(\s+\(([0-9]+:)+[0-9]+\))$`)
 
+// Chapter files written by the parser, e.g. 07 - Chapter 7.mp3. These are skipped when
+// detecting silence so re-running on the same directory doesnt split them again
+var OUTPUT_RE = regexp.MustCompile(`^[0-9]+ - .+\.(mp3|m4a|opus)$`)
+
+// Fields of a marker time, the seconds may have a fraction. e.g. 75:02.500
+var MARKER_FIELD_RE = regexp.MustCompile(`^[0-9]+$`)
+var MARKER_SECONDS_RE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
 // Remove "Part N - " from the title
 //var TITLE_RE_2 = regexp.MustCompile(`(\s*(Part)\s+\d(\s+\-\s+))`)
 
 type Marker struct {
-	Name    string
-	Time    string
-	EndTime string
-	Source  string // Source filename
+	Name   string
+	Start  time.Duration
+	End    time.Duration // Zero if the chapter runs to the end of the source
+	Source string        // Source filename
+	Auto   bool          // Detected from silence rather than read from the OverDrive tags
 }
 
 func (m *Marker) String() string {
-	return fmt.Sprintf("%s: %s-%s", m.Name, m.Time, m.EndTime)
+	end := ""
+	if m.End > 0 {
+		end = FormatMarkerTime(m.End)
+	}
+	return fmt.Sprintf("%s: %s-%s", m.Name, FormatMarkerTime(m.Start), end)
+}
+
+// Length of the chapter, zero if the end is not known
+func (m *Marker) Duration() time.Duration {
+	if m.End == 0 {
+		return 0
+	}
+	return m.End - m.Start
+}
+
+// Make sure the chapter has a length and fits in a source of the given length (0 if unknown)
+func (m *Marker) Validate(sourceLength time.Duration) error {
+	if m.Start < 0 {
+		return fmt.Errorf("chapter %s starts before the beginning of the file", m.Name)
+	}
+	if m.End != 0 && m.End <= m.Start {
+		return fmt.Errorf("chapter %s ends at %s before it starts at %s", m.Name, FormatMarkerTime(m.End), FormatMarkerTime(m.Start))
+	}
+	if sourceLength > 0 && m.Start >= sourceLength {
+		return fmt.Errorf("chapter %s starts at %s after the end of the file at %s", m.Name, FormatMarkerTime(m.Start), FormatMarkerTime(sourceLength))
+	}
+	return nil
 }
 
 func (m *Marker) NormalizeName() string {
@@ -50,54 +84,119 @@ func (m *Marker) NormalizeName() string {
 }
 
 /*
-Normalize time markers for FFMPEG. Overdrive uses minutes > 60, splt these into hours
+Parse an overdrive time marker. Overdrive uses minutes > 60 (e.g. 75:02.500) but hh:mm:ss and
+plain seconds are also accepted. Fractions of a second are kept to the nanosecond
 */
-func (m *Marker) NormalizeTime() (err error) {
-	var h, min int
-	var s float64
-
-	times := strings.Split(m.Time, ":")
-	switch len(times) {
-	case 0:
-		return fmt.Errorf("empty time block")
-	case 3:
-		h, err = strconv.Atoi(times[len(times)-3])
-		if err != nil {
-			return err
-		}
-		fallthrough
-	case 2:
-		min, err = strconv.Atoi(times[len(times)-2])
-		if err != nil {
-			return err
+func ParseMarkerTime(t string) (time.Duration, error) {
+	t = strings.TrimSpace(t)
+	if t == "" {
+		return 0, fmt.Errorf("empty time block")
+	}
+	times := strings.Split(t, ":")
+	if len(times) > 3 {
+		return 0, fmt.Errorf("invalid time %q", t)
+	}
+
+	var d time.Duration
+	units := []time.Duration{time.Second, time.Minute, time.Hour}
+	for i, unit := range units[1:len(times)] {
+		field := times[len(times)-2-i]
+		if !MARKER_FIELD_RE.MatchString(field) {
+			return 0, fmt.Errorf("invalid time %q", t)
 		}
-		fallthrough
-	case 1:
-		s, err = strconv.ParseFloat(times[len(times)-1], 64)
-		if err != nil {
-			return err
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || n > int64(math.MaxInt64/unit) || time.Duration(n)*unit > math.MaxInt64-d {
+			return 0, fmt.Errorf("time %q is out of range", t)
 		}
+		d += time.Duration(n) * unit
+	}
+	// Seconds may have a fraction, let ParseDuration keep it exact once it is only digits
+	secs := times[len(times)-1]
+	if !MARKER_SECONDS_RE.MatchString(secs) {
+		return 0, fmt.Errorf("invalid time %q", t)
 	}
+	s, err := time.ParseDuration(secs + "s")
+	if err != nil || s > math.MaxInt64-d {
+		return 0, fmt.Errorf("time %q is out of range", t)
+	}
+	return d + s, nil
+}
 
-	h += min / 60
-	min = min % 60
+// Format a time for FFMPEG as hh:mm:ss.mmm
+func FormatMarkerTime(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	h := d / time.Hour
+	d -= h * time.Hour
+	min := d / time.Minute
+	d -= min * time.Minute
+	s := d / time.Second
+	d -= s * time.Second
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, min, s, d/time.Millisecond)
+}
+
+// Markers as they are stored in the OverDrive MediaMarkers tag
+type Markers struct {
+	Markers []struct {
+		Name string
+		Time string
+	} `xml:"Marker"`
+}
+
+const (
+	DefaultSilenceGap   = 2 * time.Second
+	DefaultSilenceNoise = -30.0
+)
 
-	change := int(math.Floor(s / 60))
-	min += change
-	s -= float64(60 * change)
+// Allowed difference between the expected and real length of a split chapter
+const ChapterLengthTolerance = time.Second
 
-	m.Time = fmt.Sprintf("%02d:%02d:%0.3f", h, min, s)
-	return
+// SplitError collects the errors from every chapter that failed to split or verify
+type SplitError struct {
+	Total  int
+	Errors []error
 }
 
-type Markers struct {
-	Markers []*Marker `xml:"Marker"`
+func (e *SplitError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d of %d chapters failed: %s", len(e.Errors), e.Total, strings.Join(msgs, "; "))
+}
+
+// Options for splitting chapters, shared by every command that can run the parser
+type ChapterOptions struct {
+	Originals  string `help:"What to do with the original parts on success: keep, delete, zip, move or link" enum:"keep,delete,zip,move,link" default:"keep"`
+	ArchiveDir string `help:"Directory for the zip, moved or linked parts. The zip defaults to the parent of the out directory"`
+	ZipLevel   int    `help:"Compression level of the zip from 0 (store) to 9, -1 uses the default" default:"-1"`
+
+	NoSilence    bool          `help:"Do not detect chapters from silence when the parts have no OverDrive markers"`
+	SilenceGap   time.Duration `help:"Minimum length of a silence to be a chapter break" default:"2s"`
+	SilenceCount int           `help:"Number of chapters to look for in each part, 0 uses every silence"`
+	SilenceNoise float64       `help:"Volume in dB below which audio is considered silent" default:"-30"`
+
+	Jobs int `short:"j" help:"Number of chapters to split at once, 0 uses one per CPU"`
+
+	Sidecars   []string `help:"Metadata files to write from the ODM: opf, desc, reader and/or json"`
+	EmbedCover bool     `help:"Embed folder.jpg into every chapter"`
+
+	AudioOptions
+}
+
+// Check the chapters can be written as asked before any work is done
+func (o ChapterOptions) validateAudio() error {
+	if o.EmbedCover && o.codec() == CodecOpus {
+		return fmt.Errorf("--embed-cover cannot be used with --codec opus, opus files cannot hold cover art")
+	}
+	return nil
 }
 
 type ParseChapters struct {
-	Directory string `arg help:"directory to parse"`
-	Outdir    string `arg help:"out directory to save files to" optional:""`
-	Delete    bool   `short:"d" help:"Delete previous parts on success"`
+	Directory string `arg:"" help:"directory to parse"`
+	Outdir    string `arg:"" help:"out directory to save files to" optional:""`
+	Delete    bool   `short:"d" help:"Zip and delete the original parts on success, same as --originals=zip"`
+	Odm       string `help:"ODM file of the book to include in the zip, found in the directory if not set"`
+	ChapterOptions
 
 	logfile io.Writer
 
@@ -108,6 +207,15 @@ func (p *ParseChapters) Run() error {
 	if p.logfile == nil {
 		p.logfile = os.Stdout
 	}
+	if err := p.validateOriginals(); err != nil {
+		return err
+	}
+	if err := ValidateSidecars(p.Sidecars); err != nil {
+		return err
+	}
+	if err := p.validateAudio(); err != nil {
+		return err
+	}
 	if p.Outdir == "" {
 		p.Outdir = p.Directory
 	} else {
@@ -119,7 +227,12 @@ func (p *ParseChapters) Run() error {
 	var author, categories, summary, description string
 
 	sourceFiles := make([]string, 0)
+	unmarkedFiles := make([]string, 0)   // Parts without any OverDrive markers
+	unreadable := make(map[string]error) // Parts with markers that cannot be read
 	err := filepath.Walk(p.Directory, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		switch filepath.Ext(info.Name()) {
 		case ".txt":
 			fallthrough
@@ -128,53 +241,45 @@ func (p *ParseChapters) Run() error {
 				description = "default"
 			}
 			return nil
+		case ".odm":
+			if p.Odm == "" {
+				p.Odm = path
+			}
+			return nil
 		case ".mp3":
-			f, err := id3.Open(path)
+			markers, err := ReadMarkers(path)
 			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			// Get the overdrive media tags
-			var v v2.Framer
-			if v = f.Frame("TXXX"); v == nil {
-				return nil
-			}
-			media := strings.SplitN(v.String(), ":", 2)
-			if len(media) < 1 {
-				return nil
-			}
-			if !strings.Contains(media[0], "OverDrive MediaMarkers") {
+				if !errors.Is(err, ErrNoMarkers) && !errors.Is(err, ErrNoTag) {
+					fmt.Fprintf(p.logfile, "%+v ERR: %s\n", time.Now(), err)
+					unreadable[path] = err
+				}
+				unmarkedFiles = append(unmarkedFiles, path)
 				return nil
 			}
-			markers := &Markers{}
-			if err := xml.Unmarshal([]byte(media[1]), markers); err != nil {
-				return err
-			}
 
 			// set the title, author, for the description
-			if v := f.Frame("TPE1"); author == "" && v != nil && v.String() != "" {
-				author = v.String()
-			}
-			if v := f.Frame("TCON"); categories == "" && v != nil && v.String() != "" {
-				categories = v.String()
-			}
-			if v := f.Frame("COMM"); summary == "" && v != nil && v.String() != "" {
-				summary = strings.TrimSpace(strings.SplitN(v.String(), ":", 2)[1])
+			if f, err := OpenTag(path); err == nil {
+				if author == "" {
+					author = FrameText(f, "TPE1", "TP1")
+				}
+				if categories == "" {
+					categories = FrameText(f, "TCON", "TCO")
+				}
+				if summary == "" {
+					summary = FrameText(f, "COMM", "COM")
+				}
+				f.Close()
 			}
 
 			// Normalize the markers
-			for i, m := range markers.Markers {
+			for i, m := range markers {
 				m.NormalizeName()
 				m.Source = path
-				if err := m.NormalizeTime(); err != nil {
-					fmt.Fprintf(p.logfile, "%+v ERR: Cannot normalize time for file %s: %s\n", time.Now(), path, err)
-				}
 				if i != 0 {
 					// Add the end time to the previous marker
 					prev := p.allMarkers[len(p.allMarkers)-1]
 					if prev.Source == m.Source {
-						prev.EndTime = m.Time
+						prev.End = m.Start
 					}
 				}
 				p.allMarkers = append(p.allMarkers, m)
@@ -192,6 +297,24 @@ func (p *ParseChapters) Run() error {
 		return err
 	}
 
+	// No markers at all, guess the chapters from the gaps in the audio
+	if len(p.allMarkers) == 0 && !p.NoSilence {
+		for _, path := range unmarkedFiles {
+			if OUTPUT_RE.MatchString(filepath.Base(path)) {
+				continue
+			}
+			markers, err := p.detectChapters(path, len(p.allMarkers))
+			if err != nil {
+				fmt.Fprintf(p.logfile, "%+v ERR: Cannot detect silence in file %s: %s\n", time.Now(), path, err)
+				continue
+			}
+			fmt.Fprintf(p.logfile, "%+v No OverDrive markers in %s, auto-detected %d chapters from silence\n", time.Now(), path, len(markers))
+			p.allMarkers = append(p.allMarkers, markers...)
+			sourceFiles = append(sourceFiles, path)
+			delete(unreadable, path)
+		}
+	}
+
 	// Write the description if we dont have one
 	if description == "" && summary != "" {
 		description = fmt.Sprintf("%s<br><br>\n%s\n<br>\n%s", summary, author, categories)
@@ -201,55 +324,276 @@ func (p *ParseChapters) Run() error {
 		fmt.Fprintf(p.logfile, "%+v %s\n", time.Now(), "Saved description to about.txt")
 	}
 
-	// Print out all the markers
-	i := 0
-	// Format string used for output files, zeros padded as much as needed
-	formatStr := fmt.Sprintf("%%0%dd - %%s.mp3", len(fmt.Sprint(len(p.allMarkers))))
-	for _, marker := range p.allMarkers {
-		destination := filepath.Join(p.Outdir, fmt.Sprintf(formatStr, i, marker.Name))
-		if err := SplitMP3(marker.Source, destination, marker); err != nil {
-			fmt.Fprintf(p.logfile, "%+v ERR: Could not split file: %s\n", time.Now(), err)
+	if len(p.Sidecars) != 0 {
+		p.writeSidecars()
+	}
+
+	// Chapters that are skipped and parts that give none mean the book is incomplete
+	total := len(p.allMarkers) + len(unreadable)
+	var problems []error
+	p.allMarkers, problems = p.validateMarkers(p.allMarkers)
+	paths := make([]string, 0, len(unreadable))
+	for path := range unreadable {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		problems = append(problems, fmt.Errorf("no chapters from %s: %w", path, unreadable[path]))
+	}
+
+	// Split out all the markers
+	if err := p.splitChapters(p.allMarkers); err != nil || len(problems) > 0 {
+		split := &SplitError{Total: total}
+		var splitErr *SplitError
+		if errors.As(err, &splitErr) {
+			split.Errors = append(split.Errors, splitErr.Errors...)
+		} else if err != nil {
+			split.Errors = append(split.Errors, err)
+		}
+		split.Errors = append(split.Errors, problems...)
+		fmt.Fprintf(p.logfile, "%+v ERR: %s\n", time.Now(), split)
+		if p.originalsMode() != OriginalsKeep {
+			fmt.Fprintf(p.logfile, "%+v ERR: Not all chapters were saved, keeping the original files\n", time.Now())
 		}
-		fmt.Fprintf(p.logfile, "%+v Saved %d - %s\n", time.Now(), i, marker.Name)
-		i++
+		return split
+	}
+	if len(p.allMarkers) == 0 {
+		fmt.Fprintf(p.logfile, "%+v ERR: No chapters found, keeping the original files\n", time.Now())
+		return fmt.Errorf("no chapters found in %s", p.Directory)
 	}
 
-	// Package the old Parts into a zipfile
-	if !p.Delete {
-		return nil
+	if err := p.handleOriginals(sourceFiles); err != nil {
+		return err
 	}
-	_, file := filepath.Split(strings.TrimRight(p.Directory, "/"))
-	file = filepath.Join(p.Outdir, "..", file+".zip")
-	of, err := os.Create(file) // Output zipfile
+	p.writeManifest()
+	return nil
+}
+
+/*
+Propose chapters for a part that has no OverDrive markers, breaking at the longest silences.
+Chapters are numbered from offset+1 so they continue on from the previous part
+*/
+func (p *ParseChapters) detectChapters(path string, offset int) ([]*Marker, error) {
+	gap := p.SilenceGap
+	if gap <= 0 {
+		gap = DefaultSilenceGap
+	}
+	noise := p.SilenceNoise
+	if noise == 0 {
+		noise = DefaultSilenceNoise
+	}
+	silences, err := DetectSilence(path, noise, gap)
 	if err != nil {
-		fmt.Fprintf(p.logfile, "%+v ERR: Could not create output zipfile: %s: %s\n", time.Now(), file, err)
-		return err
+		return nil, err
 	}
-	defer of.Close()
-	zf := zip.NewWriter(of) // Output zip writer
-	defer zf.Close()
-	for _, sourceFile := range sourceFiles {
-		_, fname := filepath.Split(sourceFile)
-		f, err := zf.Create(fname)
-		if err != nil {
-			fmt.Fprintf(p.logfile, "%+v ERR: Could not create file in zipfile: %s: %s\n", time.Now(), fname, err)
-			return err
+
+	// Count chapters need one break fewer, below 1 every silence is a break
+	var breaks []time.Duration
+	if p.SilenceCount != 1 {
+		breaks = ChooseBreaks(silences, p.SilenceCount-1)
+	}
+	starts := append([]time.Duration{0}, breaks...)
+	markers := make([]*Marker, 0, len(starts))
+	for i, start := range starts {
+		m := &Marker{
+			Name:   fmt.Sprintf("Chapter %d (auto-detected)", offset+i+1),
+			Start:  start,
+			Source: path,
+			Auto:   true,
 		}
-		sf, err := os.Open(sourceFile)
-		if err != nil {
-			fmt.Fprintf(p.logfile, "%+v ERR: Could not read file: %s: %s\n", time.Now(), sourceFile, err)
-			return err
+		if i+1 < len(starts) {
+			m.End = starts[i+1]
 		}
-		defer sf.Close()
-		if _, err := io.Copy(f, sf); err != nil {
-			fmt.Fprintf(p.logfile, "%+v ERR: Could not read file: %s: %s\n", time.Now(), sourceFile, err)
-			return err
+		m.NormalizeName()
+		markers = append(markers, m)
+	}
+	return markers, nil
+}
+
+/*
+Set the end of the last chapter in each part to the real length of the part and drop any
+chapters with no length, these would make ffmpeg fail or write an empty file
+*/
+func (p *ParseChapters) validateMarkers(markers []*Marker) ([]*Marker, []error) {
+	lengths := make(map[string]time.Duration)
+	for i, m := range markers {
+		if _, ok := lengths[m.Source]; !ok {
+			d, err := Duration(m.Source)
+			if err != nil {
+				fmt.Fprintf(p.logfile, "%+v ERR: Cannot get length of %s: %s\n", time.Now(), m.Source, err)
+			}
+			lengths[m.Source] = d
 		}
-		if err := os.Remove(sourceFile); err != nil {
-			fmt.Fprintf(p.logfile, "%+v ERR: Could not delete file: %s: %s\n", time.Now(), sourceFile, err)
-			return err
+		last := i+1 == len(markers) || markers[i+1].Source != m.Source
+		if last && m.End == 0 {
+			m.End = lengths[m.Source]
+		}
+	}
+
+	valid := make([]*Marker, 0, len(markers))
+	var skipped []error
+	for _, m := range markers {
+		if err := m.Validate(lengths[m.Source]); err != nil {
+			fmt.Fprintf(p.logfile, "%+v ERR: Skipping chapter in %s: %s\n", time.Now(), m.Source, err)
+			skipped = append(skipped, fmt.Errorf("skipped chapter %q in %s: %w", m.Name, m.Source, err))
+			continue
+		}
+		valid = append(valid, m)
+	}
+	return valid, skipped
+}
+
+/*
+Split the chapters out of the parts using a pool of p.Jobs ffmpeg workers. Progress is logged
+in chapter order no matter which worker finishes first
+*/
+func (p *ParseChapters) splitChapters(markers []*Marker) error {
+	jobs := p.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+	indexes := make(chan int)
+	results := make(chan result)
+	wg := &sync.WaitGroup{}
+	cover := ""
+	if p.EmbedCover {
+		cover = p.cover()
+		if cover == "" {
+			fmt.Fprintf(p.logfile, "%+v ERR: No folder.jpg found, not embedding cover art\n", time.Now())
+		}
+	}
+	// Format string used for output files, zeros padded as much as needed
+	formatStr := fmt.Sprintf("%%0%dd - %%s%s", len(fmt.Sprint(len(markers))), p.AudioOptions.Ext())
+	for w := 0; w < jobs; w++ {
+		go func(wg *sync.WaitGroup) {
+			defer wg.Done()
+			for i := range indexes {
+				marker := markers[i]
+				destination := filepath.Join(p.Outdir, fmt.Sprintf(formatStr, i, marker.Name))
+				err := SplitAudio(marker.Source, destination, marker, p.AudioOptions)
+				if err == nil {
+					err = verifyChapter(destination, p.AudioOptions.Length(marker.Duration()))
+				}
+				if err == nil && cover != "" {
+					err = EmbedCover(destination, cover)
+				}
+				results <- result{i, err}
+			}
+		}(wg)
+		wg.Add(1)
+	}
+	go func() {
+		for i := range markers {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Hold on to results that finish early until every chapter before them is logged
+	errs := make([]error, 0)
+	done := make(map[int]error)
+	next := 0
+	for r := range results {
+		done[r.i] = r.err
+		for {
+			err, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			if err != nil {
+				fmt.Fprintf(p.logfile, "%+v ERR: Could not split file: %s\n", time.Now(), err)
+				errs = append(errs, fmt.Errorf("%d - %s: %w", next, markers[next].Name, err))
+			} else {
+				fmt.Fprintf(p.logfile, "%+v Saved %d - %s\n", time.Now(), next, markers[next].Name)
+			}
+			next++
 		}
 	}
-	fmt.Fprintf(p.logfile, "%+v Saved original files to %s\n", time.Now(), file)
+	if len(errs) != 0 {
+		return &SplitError{Total: len(markers), Errors: errs}
+	}
 	return nil
 }
+
+// Make sure a split chapter exists and is about as long as expected, 0 if the length is unknown
+func verifyChapter(destination string, expected time.Duration) error {
+	info, err := os.Stat(destination)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", destination)
+	}
+	if expected == 0 {
+		return nil
+	}
+	length, err := Duration(destination)
+	if err != nil {
+		return err
+	}
+	diff := length - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > ChapterLengthTolerance {
+		return fmt.Errorf("%s is %s long, expected %s", destination, length, expected)
+	}
+	return nil
+}
+
+// Find the cover image of the book
+func (p *ParseChapters) cover() string {
+	for _, dir := range []string{p.Directory, p.Outdir} {
+		cover := filepath.Join(dir, "folder.jpg")
+		if i, err := os.Stat(cover); err == nil && i.Size() > 0 {
+			return cover
+		}
+	}
+	return ""
+}
+
+// Write the requested sidecar files from the ODM metadata
+func (p *ParseChapters) writeSidecars() {
+	if p.Odm == "" {
+		fmt.Fprintf(p.logfile, "%+v ERR: No ODM file found, cannot write metadata files\n", time.Now())
+		return
+	}
+	odm, err := NewODMFile(p.Odm)
+	if err != nil {
+		fmt.Fprintf(p.logfile, "%+v ERR: Could not read ODM file: %s\n", time.Now(), err)
+		return
+	}
+	md, err := odm.GetMetadata()
+	if err != nil {
+		fmt.Fprintf(p.logfile, "%+v ERR: Could not read ODM metadata: %s\n", time.Now(), err)
+		return
+	}
+	if err := WriteSidecars(p.Outdir, Book{Id: odm.Id, Metadata: md}, p.Sidecars); err != nil {
+		fmt.Fprintf(p.logfile, "%+v ERR: Could not write metadata files: %s\n", time.Now(), err)
+		return
+	}
+	fmt.Fprintf(p.logfile, "%+v Saved metadata files: %s\n", time.Now(), strings.Join(p.Sidecars, ", "))
+}
+
+// Record the checksums of the finished chapters, a bad manifest does not fail the parse
+func (p *ParseChapters) writeManifest() {
+	odmId := ""
+	if p.Odm != "" {
+		if odm, err := NewODMFile(p.Odm); err == nil {
+			odmId = odm.Id
+		}
+	}
+	if err := WriteManifest(p.Outdir, odmId); err != nil {
+		fmt.Fprintf(p.logfile, "%+v ERR: Could not write manifest: %s\n", time.Now(), err)
+		return
+	}
+	fmt.Fprintf(p.logfile, "%+v Saved manifest to %s\n", time.Now(), ManifestName)
+}
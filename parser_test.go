@@ -0,0 +1,52 @@
+package godm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMarkerTime(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		err  bool
+	}{
+		{"75:02.500", 75*time.Minute + 2500*time.Millisecond, false},
+		{"1:02:03", time.Hour + 2*time.Minute + 3*time.Second, false},
+		{"42", 42 * time.Second, false},
+		{"0:00.123456789", 123456789 * time.Nanosecond, false},
+		{" 1:00 ", time.Minute, false},
+		{"", 0, true},
+		{"1:2:3:4", 0, true},
+		{"x:00", 0, true},
+		{"-1", 0, true},
+		{"+1", 0, true},
+		{"-1:00", 0, true},
+		{"+1:00", 0, true},
+		{"1.", 0, true},
+		{".5", 0, true},
+		{"1e3", 0, true},
+		{"0:1h2", 0, true},
+		{"5:1m", 0, true},
+		{"5:1s", 0, true},
+		{"153722867280912930:0", 0, true},
+		{"2562047:47:16.854775808", 0, true},
+		{"2562047:47:17", 0, true},
+		{"99999999999999999999", 0, true},
+		{"2562047:47:16", 2562047*time.Hour + 47*time.Minute + 16*time.Second, false},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			d, err := ParseMarkerTime(test.text)
+			if test.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", d)
+				}
+				return
+			}
+			if err != nil || d != test.want {
+				t.Fatalf("got %v and error %v, want %v", d, err, test.want)
+			}
+		})
+	}
+}
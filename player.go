@@ -0,0 +1,99 @@
+package godm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Position is where a user is in a book
+type Position struct {
+	File    string    `json:"file"` // Chapter file being played
+	Time    float64   `json:"time"` // Seconds into the chapter
+	Updated time.Time `json:"updated"`
+}
+
+// PositionStore keeps the playback position of every user in every book, one file per user
+type PositionStore struct {
+	dir   string
+	mu    sync.Mutex
+	users map[string]map[string]Position // User, then book id
+}
+
+func NewPositionStore(dir string) (*PositionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &PositionStore{dir: dir, users: make(map[string]map[string]Position)}, nil
+}
+
+// File of the positions of a user. User names cannot start with _ so it is free for no user
+func (p *PositionStore) file(user string) (string, error) {
+	if user == "" {
+		user = "_"
+	}
+	return safeJoin(p.dir, user+".json")
+}
+
+// Positions of the user by book, read from disk the first time. Called with the lock held
+func (p *PositionStore) load(user string) (map[string]Position, error) {
+	if positions, ok := p.users[user]; ok {
+		return positions, nil
+	}
+	positions := make(map[string]Position)
+	file, err := p.file(user)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &positions); err != nil {
+			return nil, err
+		}
+	}
+	p.users[user] = positions
+	return positions, nil
+}
+
+// Where the user is in the book, false if they have not played it
+func (p *PositionStore) Get(user, book string) (Position, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	positions, err := p.load(user)
+	if err != nil {
+		return Position{}, false, err
+	}
+	pos, ok := positions[book]
+	return pos, ok, nil
+}
+
+// Remember where the user is in the book
+func (p *PositionStore) Set(user, book string, pos Position) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	positions, err := p.load(user)
+	if err != nil {
+		return err
+	}
+	pos.Updated = time.Now()
+	positions[book] = pos
+	file, err := p.file(user)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(positions, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves half a file
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,163 @@
+package godm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of bytes per second, shared by every download using it
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes added to the bucket every second
+	burst  float64 // Size of the bucket
+	tokens float64
+	last   time.Time
+}
+
+// Create a limiter for the rate in bytes per second. A rate of 0 means no limit and returns nil
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:  float64(rate),
+		burst: float64(rate),
+		last:  time.Now(),
+	}
+}
+
+// Block until n bytes may be read. Safe to call on a nil limiter
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Take the tokens now, going into debt reserves them so waiting readers queue up fairly
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Wrap a reader so everything read from it counts against the limit
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the workers taking turns instead of one taking the whole second
+	if chunk := int(lr.l.rate / 10); len(p) > chunk && chunk > 0 {
+		p = p[:chunk]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.WaitN(n)
+	return n, err
+}
+
+// Parse a rate such as 500K, 2M or 1048576 into bytes per second. Empty is no limit
+func ParseRate(rate string) (int64, error) {
+	n, err := ParseSize(rate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 500K or 2M", rate)
+	}
+	return n, nil
+}
+
+// Parse a size such as 10K, 2M or 9999 into bytes. Empty is 0
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 10K or 2M", size)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// QuietHours is a daily window, e.g. 23:00-07:00, when no new downloads are started
+type QuietHours struct {
+	Start time.Duration // Time of day the quiet hours start
+	End   time.Duration // Time of day they end, may be before Start to wrap past midnight
+}
+
+// Parse quiet hours in the form hh:mm-hh:mm. Empty means there are none and returns nil
+func ParseQuietHours(s string) (*QuietHours, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	times := strings.Split(s, "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid quiet hours %q, expected e.g. 23:00-07:00", s)
+	}
+	q := &QuietHours{}
+	for i, dest := range []*time.Duration{&q.Start, &q.End} {
+		t, err := time.Parse("15:04", strings.TrimSpace(times[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet hours %q, expected e.g. 23:00-07:00", s)
+		}
+		*dest = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return q, nil
+}
+
+func (q *QuietHours) String() string {
+	return fmt.Sprintf("%s-%s", clock(q.Start), clock(q.End))
+}
+
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// How long until the quiet hours end, 0 if it is not quiet at t. Safe to call on nil
+func (q *QuietHours) Remaining(t time.Time) time.Duration {
+	if q == nil || q.Start == q.End {
+		return 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	switch {
+	case q.Start < q.End && now >= q.Start && now < q.End:
+		return q.End - now
+	case q.Start > q.End && now >= q.Start:
+		return 24*time.Hour - now + q.End
+	case q.Start > q.End && now < q.End:
+		return q.End - now
+	}
+	return 0
+}
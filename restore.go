@@ -0,0 +1,143 @@
+package godm
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Restore struct {
+	Zip    string `arg:"" help:"Zip of the original parts made by parse" type:"existingfile"`
+	Outdir string `arg:"" help:"Book directory to restore into, defaults to the zip name next to the zip" optional:""`
+	Force  bool   `short:"f" help:"Overwrite files that already exist in the book directory"`
+	Parse  bool   `short:"p" help:"Split the chapters again once the parts are restored"`
+
+	Format  string `help:"Format the book was downloaded in, as given to download --format"`
+	Quality string `help:"Quality the book was downloaded in, as given to download --quality"`
+	ChapterOptions
+}
+
+func (r *Restore) Run() error {
+	if r.Outdir == "" {
+		r.Outdir = strings.TrimSuffix(r.Zip, filepath.Ext(r.Zip))
+	}
+	if err := os.MkdirAll(r.Outdir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Println("Extracting", r.Zip, "to", r.Outdir)
+	odm, err := r.extract()
+	if err != nil {
+		return err
+	}
+
+	if odm == "" {
+		fmt.Println("No ODM file in the zip, cannot verify the parts")
+	} else {
+		fmt.Println("Verifying parts against", odm)
+		if err := verifyODM(odm, r.Format, r.Quality, r.Outdir); err != nil {
+			return err
+		}
+		fmt.Println("All parts restored")
+	}
+
+	if !r.Parse {
+		return nil
+	}
+	fmt.Println("Splitting chapters")
+	parser := ParseChapters{
+		Directory:      r.Outdir,
+		Odm:            odm,
+		ChapterOptions: r.ChapterOptions,
+	}
+	return parser.Run()
+}
+
+/*
+Unpack every file in the zip into the book directory. Files that already exist are kept
+unless Force is set. Returns the path to the ODM file if the zip had one
+*/
+func (r *Restore) extract() (string, error) {
+	zr, err := zip.OpenReader(r.Zip)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	odm := ""
+	for _, zf := range zr.File {
+		// Parse only ever writes flat zips, never trust a path from inside one
+		name := filepath.Base(filepath.Clean("/" + zf.Name))
+		if zf.FileInfo().IsDir() || name == "/" || name == "." {
+			continue
+		}
+		outfile := filepath.Join(r.Outdir, name)
+		if strings.HasSuffix(name, ".odm") {
+			odm = outfile
+		}
+		if i, err := os.Stat(outfile); err == nil && !r.Force {
+			if i.Size() != int64(zf.UncompressedSize64) {
+				fmt.Printf("Skipping %s, a different file already exists (use --force to overwrite)\n", name)
+			}
+			continue
+		}
+		if err := extractFile(zf, outfile); err != nil {
+			return "", fmt.Errorf("could not extract %s: %s", name, err)
+		}
+		fmt.Println("Restored", name)
+	}
+	return odm, nil
+}
+
+func extractFile(zf *zip.File, outfile string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(outfile)
+		return err
+	}
+	return f.Close()
+}
+
+// Check the parts of the format chosen by name and quality in the ODM file, see FindFormat
+func verifyODM(odmfile, name, quality, dir string) error {
+	odm, err := NewODMFile(odmfile)
+	if err != nil {
+		return err
+	}
+	if err := odm.SelectFormat(name, quality); err != nil {
+		return err
+	}
+	return VerifyParts(odm.chooseBestFormat(), dir)
+}
+
+// Check every part of the format exists in the directory with the right size
+func VerifyParts(format Format, dir string) error {
+	missing := make([]string, 0)
+	for _, part := range format.Parts.Part {
+		filename := filepath.Join(dir, part.LocalName())
+		s, err := os.Stat(filename)
+		if err != nil {
+			missing = append(missing, part.LocalName())
+			continue
+		}
+		if s.Size() != int64(part.FileSize) {
+			missing = append(missing, fmt.Sprintf("%s (%d bytes, expected %d)", part.LocalName(), s.Size(), part.FileSize))
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%d parts missing or incomplete: %s", len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package godm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Sidecar files that can be written next to the chapters
+const (
+	SidecarOPF    = "opf"    // metadata.opf for Calibre and Audiobookshelf
+	SidecarDesc   = "desc"   // desc.txt, the plain text description
+	SidecarReader = "reader" // reader.txt, the narrators
+	SidecarJSON   = "json"   // metadata.json, everything parsed from the ODM
+)
+
+var sidecarFiles = map[string]string{
+	SidecarOPF:    "metadata.opf",
+	SidecarDesc:   "desc.txt",
+	SidecarReader: "reader.txt",
+	SidecarJSON:   "metadata.json",
+}
+
+// Strip html tags from the overdrive description
+var HTML_TAG_RE = regexp.MustCompile(`<[^>]*>`)
+
+// Roles from the ODM and their MARC relator codes used in the OPF
+var opfRoles = map[string]string{
+	"author":      "aut",
+	"narrator":    "nrt",
+	"editor":      "edt",
+	"translator":  "trl",
+	"illustrator": "ill",
+}
+
+var opfTemplate = template.Must(template.New("opf").Funcs(template.FuncMap{
+	"x":    xmlEscape,
+	"role": func(r string) string { return opfRoles[strings.ToLower(r)] },
+	"text": PlainText,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package version="2.0" xmlns="http://www.idpf.org/2007/opf" unique-identifier="BookId">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:identifier id="BookId" opf:scheme="OverDrive">{{x .Id}}</dc:identifier>
+    <dc:title>{{x .Title}}</dc:title>
+{{- range .Creators.Creators}}{{if role .Role}}
+    <dc:creator opf:role="{{role .Role}}"{{if .FileAs}} opf:file-as="{{x .FileAs}}"{{end}}>{{x (text .Name)}}</dc:creator>
+{{- end}}{{end}}
+{{- if .Publisher}}
+    <dc:publisher>{{x .Publisher}}</dc:publisher>{{end}}
+{{- if .PublishDate}}
+    <dc:date>{{x .PublishDate}}</dc:date>{{end}}
+{{- range .Languages.Languages}}
+    <dc:language>{{x .Code}}</dc:language>{{end}}
+{{- range .Subjects.Subjects}}
+    <dc:subject>{{x .}}</dc:subject>{{end}}
+{{- if .Description}}
+    <dc:description>{{x .Description}}</dc:description>{{end}}
+{{- if .SubTitle}}
+    <meta name="calibre:subtitle" content="{{x .SubTitle}}"/>{{end}}
+{{- if .Series}}
+    <meta name="calibre:series" content="{{x .Series}}"/>{{end}}
+  </metadata>
+</package>
+`))
+
+// Book is the ODM metadata along with the ODM id, as written to metadata.json
+type Book struct {
+	Id string
+	*Metadata
+}
+
+func xmlEscape(s string) string {
+	b := new(bytes.Buffer)
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+// Convert the html description from overdrive into plain text
+func PlainText(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n\n").Replace(s)
+	s = HTML_TAG_RE.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// Check the requested sidecars are all known
+func ValidateSidecars(sidecars []string) error {
+	for _, s := range sidecars {
+		if _, ok := sidecarFiles[s]; !ok {
+			return fmt.Errorf("unknown sidecar %q, expected one of opf, desc, reader or json", s)
+		}
+	}
+	return nil
+}
+
+// Write the requested sidecar files for the book into dir
+func WriteSidecars(dir string, book Book, sidecars []string) error {
+	for _, s := range sidecars {
+		var data []byte
+		switch s {
+		case SidecarOPF:
+			b := new(bytes.Buffer)
+			if err := opfTemplate.Execute(b, book); err != nil {
+				return err
+			}
+			data = b.Bytes()
+		case SidecarDesc:
+			data = []byte(PlainText(book.Description) + "\n")
+		case SidecarReader:
+			narrator := book.GetNarrator()
+			if narrator == "" {
+				continue
+			}
+			data = []byte(PlainText(narrator) + "\n")
+		case SidecarJSON:
+			var err error
+			if data, err = json.MarshalIndent(book, "", "  "); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown sidecar %q", s)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, sidecarFiles[s]), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Actions that can be run on a job, and the states they make sense in
+var actions = {
+    retry: ["done", "failed"],
+    cancel: ["queued", "licensing", "downloading", "validating", "returning"],
+    return: ["splitting", "done", "failed"],
+    delete: ["done", "failed"]
+}
+
+function formatTime(t) {
+    // Unset times come back as the zero time
+    if (!t || t.startsWith("0001")) {
+        return ""
+    }
+    return new Date(t).toLocaleString()
+}
+
+var dashboard = {
+    prefix: "",
+    init: function () {
+        dashboard.prefix = document.getElementById("dashboard").dataset.prefix;
+        dashboard.refresh();
+        setInterval(dashboard.refresh, 3000);
+    },
+    api: function (path) {
+        return dashboard.prefix + "/api/v1/" + path;
+    },
+    refresh: function () {
+        fetch(dashboard.api("jobs"))
+            .then(r => r.json())
+            .then(jobs => dashboard.render(jobs.reverse()))
+            .catch(e => console.log("Could not load jobs", e));
+    },
+    render: function (jobs) {
+        var tbody = document.getElementById("jobs");
+        tbody.innerHTML = "";
+        document.getElementById("empty").style.display = jobs.length ? "none" : "block";
+        jobs.forEach(job => {
+            var row = document.createElement("tr");
+            row.className = job.state;
+
+            var cover = document.createElement("img");
+            cover.className = "thumbnail";
+            cover.src = dashboard.api("jobs/" + encodeURIComponent(job.id) + "/cover");
+            cover.onerror = () => cover.style.visibility = "hidden";
+            dashboard.cell(row).appendChild(cover);
+
+            var book = dashboard.cell(row);
+            var link = document.createElement("a");
+            link.href = dashboard.prefix + "/status?id=" + encodeURIComponent(job.id);
+            link.textContent = job.title || job.name;
+            book.appendChild(link);
+            if (job.author) {
+                book.appendChild(document.createElement("br"));
+                book.appendChild(document.createTextNode(job.author));
+            }
+            if (job.owner) {
+                var owner = document.createElement("div");
+                owner.className = "owner";
+                owner.textContent = "Uploaded by " + job.owner;
+                book.appendChild(owner);
+            }
+            if (job.error) {
+                var err = document.createElement("div");
+                err.className = "error";
+                err.textContent = job.error;
+                book.appendChild(err);
+            }
+
+            dashboard.cell(row).textContent = job.state + (job.returned ? " (returned)" : "");
+            var bar = document.createElement("progress");
+            bar.max = 1;
+            bar.value = job.state == "done" ? 1 : job.progress;
+            dashboard.cell(row).appendChild(bar);
+            dashboard.cell(row).textContent = formatTime(job.started);
+            dashboard.cell(row).textContent = formatTime(job.finished);
+            dashboard.cell(row).textContent = formatTime(job.expires);
+
+            var buttons = dashboard.cell(row);
+            Object.keys(actions).forEach(action => {
+                if (!actions[action].includes(job.state) || (action == "return" && job.returned)) {
+                    return;
+                }
+                var button = document.createElement("button");
+                button.textContent = action;
+                button.onclick = () => dashboard.run(job, action);
+                buttons.appendChild(button);
+            });
+            tbody.appendChild(row);
+        });
+    },
+    cell: function (row) {
+        var td = document.createElement("td");
+        row.appendChild(td);
+        return td;
+    },
+    run: function (job, action) {
+        if ((action == "delete" || action == "return") && !confirm(action + " " + (job.title || job.name) + "?")) {
+            return;
+        }
+        var path = "jobs/" + encodeURIComponent(job.id);
+        var req = action == "delete" ? fetch(dashboard.api(path), {method: "DELETE"})
+            : fetch(dashboard.api(path + "/" + action), {method: "POST"});
+        req.then(r => r.ok ? null : r.json().then(e => alert(e.error)))
+            .then(dashboard.refresh);
+    }
+}
+window.addEventListener("DOMContentLoaded", dashboard.init);
@@ -0,0 +1,136 @@
+var library = {
+    prefix: "",
+    book: null, // Book being played, with its chapters
+    chapter: -1, // Index of the chapter in the player
+    saved: 0, // When the position was last saved
+    init: function () {
+        var el = document.getElementById("library");
+        library.prefix = el.dataset.prefix;
+        if (el.dataset.id) {
+            library.open(el.dataset.id);
+        } else {
+            library.list();
+        }
+    },
+    api: function (path, id, params) {
+        var url = library.prefix + "/api/v1/library" + path;
+        if (id) {
+            url += "?id=" + encodeURIComponent(id);
+            Object.keys(params || {}).forEach(k => url += "&" + k + "=" + encodeURIComponent(params[k]));
+        }
+        return url;
+    },
+    list: function () {
+        fetch(library.api(""))
+            .then(r => r.json())
+            .then(books => {
+                var el = document.getElementById("books");
+                document.getElementById("empty").style.display = books.length ? "none" : "block";
+                books.forEach(b => {
+                    var link = document.createElement("a");
+                    link.className = "shelf";
+                    link.href = library.prefix + "/library?id=" + encodeURIComponent(b.id);
+                    if (b.cover) {
+                        var cover = document.createElement("img");
+                        cover.className = "cover";
+                        cover.src = library.api("/cover", b.id);
+                        link.appendChild(cover);
+                    }
+                    var title = document.createElement("div");
+                    title.className = "title";
+                    title.textContent = b.title;
+                    link.appendChild(title);
+                    if (b.author) {
+                        var author = document.createElement("div");
+                        author.className = "author";
+                        author.textContent = b.author;
+                        link.appendChild(author);
+                    }
+                    el.appendChild(link);
+                });
+            })
+            .catch(e => console.log("Could not load library", e));
+    },
+    open: function (id) {
+        document.getElementById("empty").style.display = "none";
+        fetch(library.api("/book", id))
+            .then(r => r.json().then(book => {
+                if (!r.ok) {
+                    throw new Error(book.error);
+                }
+                library.show(book);
+            }))
+            .catch(e => {
+                var empty = document.getElementById("empty");
+                empty.textContent = e.message;
+                empty.style.display = "block";
+            });
+    },
+    show: function (book) {
+        library.book = book;
+        document.getElementById("book").style.display = "flex";
+        document.getElementById("title").textContent = book.title;
+        document.getElementById("author").textContent = book.author || "";
+        var cover = document.getElementById("cover");
+        if (book.cover) {
+            cover.src = library.api("/cover", book.id);
+        } else {
+            cover.style.display = "none";
+        }
+        var list = document.getElementById("chapters");
+        book.chapters.forEach((c, i) => {
+            var item = document.createElement("li");
+            item.textContent = c.name;
+            item.onclick = () => library.play(i, 0, true);
+            list.appendChild(item);
+        });
+
+        var player = document.getElementById("player");
+        player.addEventListener("timeupdate", () => {
+            // Often enough to come back to about the same place
+            if (Date.now() - library.saved > 10000) {
+                library.save();
+            }
+        });
+        player.addEventListener("pause", library.save);
+        player.addEventListener("ended", () => {
+            if (library.chapter + 1 < book.chapters.length) {
+                library.play(library.chapter + 1, 0, true);
+            }
+        });
+
+        // Start where the user left off
+        var start = 0, time = 0;
+        if (book.position) {
+            var i = book.chapters.findIndex(c => c.file == book.position.file);
+            if (i >= 0) {
+                start = i;
+                time = book.position.time;
+            }
+        }
+        library.play(start, time, false);
+    },
+    play: function (i, time, autoplay) {
+        var player = document.getElementById("player");
+        var chapter = library.book.chapters[i];
+        library.chapter = i;
+        player.src = library.api("/stream", library.book.id, {file: chapter.file});
+        player.addEventListener("loadedmetadata", () => {
+            player.currentTime = time;
+        }, {once: true});
+        if (autoplay) {
+            player.play();
+        }
+        document.querySelectorAll("#chapters li").forEach((li, j) => li.className = j == i ? "playing" : "");
+    },
+    save: function () {
+        var player = document.getElementById("player");
+        library.saved = Date.now();
+        fetch(library.api("/position", library.book.id), {
+            method: "PUT",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({file: library.book.chapters[library.chapter].file, time: player.currentTime})
+        }).catch(e => console.log("Could not save position", e));
+    }
+}
+window.addEventListener("DOMContentLoaded", library.init);
@@ -0,0 +1,66 @@
+// Stages of a job in order, the current one is highlighted
+var stages = ["queued", "licensing", "downloading", "validating", "returning", "splitting", "done"]
+
+var jobStatus = {
+    el: null, // HTML job container
+    source: null, // EventSource of the job events
+    init: function () {
+        jobStatus.el = document.getElementById("job");
+        var url = jobStatus.el.dataset.prefix + "/api/v1/jobs/" + encodeURIComponent(jobStatus.el.dataset.id) + "/events";
+        jobStatus.source = new EventSource(url);
+        jobStatus.source.addEventListener("job", e => jobStatus.update(JSON.parse(e.data).data));
+        jobStatus.source.addEventListener("progress", e => jobStatus.update(JSON.parse(e.data).data));
+        jobStatus.source.addEventListener("log", e => jobStatus.log(JSON.parse(e.data)));
+    },
+    update: function (job) {
+        if (job.title) {
+            document.getElementById("title").textContent = job.title + (job.author ? " - " + job.author : "");
+        }
+        var stage = document.getElementById("stage");
+        stage.innerHTML = "";
+        var current = job.state == "failed" ? -1 : stages.indexOf(job.state);
+        stages.forEach((s, i) => {
+            var span = document.createElement("span");
+            span.textContent = s;
+            span.className = i < current ? "stage past" : i == current ? "stage current" : "stage";
+            stage.appendChild(span);
+        });
+        if (job.state == "failed") {
+            var span = document.createElement("span");
+            span.textContent = "failed";
+            span.className = "stage failed";
+            stage.appendChild(span);
+        }
+        document.getElementById("progress").value = job.progress;
+        document.getElementById("error").textContent = job.error || "";
+
+        var parts = document.getElementById("parts");
+        parts.innerHTML = "";
+        (job.parts || []).forEach(p => {
+            var row = document.createElement("div");
+            row.className = "part " + p.state;
+            var label = document.createElement("label");
+            label.textContent = p.name || "Part " + p.number;
+            var bar = document.createElement("progress");
+            bar.max = p.size;
+            bar.value = p.downloaded;
+            row.appendChild(label);
+            row.appendChild(bar);
+            parts.appendChild(row);
+        });
+
+        // Nothing more will happen, stop the browser reconnecting
+        if (job.state == "done" || job.state == "failed") {
+            jobStatus.source.close();
+        }
+    },
+    log: function (e) {
+        var line = document.createElement("div");
+        line.textContent = e.message;
+        if (e.level == "ERR") {
+            line.className = "error";
+        }
+        document.getElementById("log").appendChild(line);
+    }
+}
+window.addEventListener("DOMContentLoaded", jobStatus.init);
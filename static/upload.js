@@ -12,7 +12,17 @@ var upload = {
     dropbox: null, // HTML upload zone
     stats: null, // HTML upload status
     form: null, // HTML upload form
+    prefix: "",
+    ext: ".odm", // Limits of the server, from the page
+    maxSize: 0,
+    maxFiles: 0,
+    files: {}, // Last dropped files by name, to upload a duplicate again
     init : function () {
+        var settings = document.querySelector(".container").dataset;
+        upload.prefix = settings.prefix;
+        upload.ext = settings.ext;
+        upload.maxSize = parseInt(settings.maxSize);
+        upload.maxFiles = parseInt(settings.maxFiles);
         upload.dropbox = document.getElementById("dropbox");
         upload.stats = document.getElementById("statistics");
         upload.form = document.getElementById("odmUpload");
@@ -37,22 +47,41 @@ var upload = {
                 e.preventDefault();
                 e.stopPropagation();
                 upload.dropbox.classList.remove('hover');
-                var data = e.dataTransfer, files = data.files;
-                if (files.length > 1) {
-                    errorMessage(upload.dropbox, "Only 1 file may be uploaded")
+                var data = e.dataTransfer, files = Array.from(data.files);
+                if (files.length == 0) {
                     return
                 }
-                // Validate the file
-                if (!files[0].name.endsWith(".odm")) {
-                    errorMessage(upload.dropbox, "Only '.odm' files may be uploaded")
+                if (files.length > upload.maxFiles) {
+                    errorMessage(upload.dropbox, "At most " + upload.maxFiles + " files may be uploaded at once")
                     return
                 }
-                if (files[0].size > 9999) {
-                    errorMessage(upload.dropbox, "File exceeds size limit")
+                // Files that cannot be ODMs are reported here rather than uploaded
+                var form = new FormData(), results = []
+                upload.files = {}
+                files.forEach(f => {
+                    upload.files[f.name] = f
+                    if (!f.name.endsWith(upload.ext)) {
+                        results.push({file: f.name, result: "invalid", error: "Only '" + upload.ext + "' files may be uploaded"})
+                    } else if (f.size > upload.maxSize) {
+                        results.push({file: f.name, result: "invalid", error: "File exceeds size limit of " + upload.maxSize + " bytes"})
+                    } else {
+                        form.append("odmFile", f, f.name)
+                    }
+                })
+                if (!form.has("odmFile")) {
+                    upload.show(results)
                     return
                 }
-                document.getElementById("fileInput").files = files
-                upload.form.submit()
+                upload.dropbox.classList.add("busy")
+                fetch(upload.prefix + "/api/v1/uploads", {method: "POST", body: form})
+                    .then(r => r.json().then(body => {
+                        if (!r.ok) {
+                            throw new Error(body.error)
+                        }
+                        upload.show(results.concat(body))
+                    }))
+                    .catch(err => errorMessage(upload.dropbox, err.message))
+                    .finally(() => upload.dropbox.classList.remove("busy"))
             });
         }
 
@@ -60,6 +89,52 @@ var upload = {
             upload.dropbox.style.display = "none";
             upload.form.style.display = "block";
         }
+    },
+    show: function (results) {
+        upload.stats.innerHTML = ""
+        results.forEach(r => upload.stats.appendChild(upload.row(r)))
+    },
+    // Line showing what happened to one uploaded file
+    row: function (r) {
+        var row = document.createElement("div")
+        row.className = "upload " + r.result
+        var name = r.file
+        if (r.job) {
+            name = document.createElement("a")
+            name.href = upload.prefix + "/status?id=" + encodeURIComponent(r.job.id)
+            name.textContent = r.job.title || r.file
+        }
+        var result = document.createElement("span")
+        result.className = "result"
+        result.textContent = r.result
+        row.append(result, name)
+        if (r.error) {
+            var err = document.createElement("span")
+            err.className = "message"
+            err.textContent = r.error
+            row.append(err)
+        }
+        if (r.result == "duplicate" && upload.files[r.file]) {
+            ["resume", "redownload", "link"].forEach(choice => {
+                var button = document.createElement("button")
+                button.textContent = choice
+                button.onclick = () => upload.again(r.file, choice, row)
+                row.append(button)
+            })
+        }
+        return row
+    },
+    // Upload a duplicate again, saying what to do with the book we already have
+    again: function (name, choice, row) {
+        var form = new FormData()
+        form.append("odmFile", upload.files[name], name)
+        form.append("duplicate", choice)
+        fetch(upload.prefix + "/api/v1/uploads", {method: "POST", body: form})
+            .then(r => r.json())
+            .then(body => {
+                var r = Array.isArray(body) ? body[0] : {file: name, result: "error", error: body.error}
+                upload.stats.replaceChild(upload.row(r), row)
+            })
     }
 }
 window.addEventListener("DOMContentLoaded", upload.init);
\ No newline at end of file
@@ -1,12 +1,17 @@
 package godm
 
 import (
-	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,7 +21,34 @@ import (
 )
 
 func (s *Server) index(w http.ResponseWriter, r *http.Request) {
-	if err := Templates.Execute(w, s.Prefix); err != nil {
+	// The upload page checks files against the same limits as the server
+	data := struct {
+		Prefix         string
+		Ext            string
+		MaxUploadSize  int64
+		MaxUploadFiles int
+	}{s.Prefix, odmExt, s.maxUploadSize, maxUploadFiles}
+	if err := Templates.Execute(w, data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error rendering template"))
+		log.Println(r.RemoteAddr, r.RequestURI, http.StatusInternalServerError, "Error rendering template")
+		return
+	}
+}
+
+// The library page lists the books, with ?id= it plays one
+func (s *Server) library(w http.ResponseWriter, r *http.Request) {
+	data := struct{ Prefix, Id string }{s.Prefix, r.URL.Query().Get("id")}
+	if err := Templates.ExecuteTemplate(w, "library", data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error rendering template"))
+		log.Println(r.RemoteAddr, r.RequestURI, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	if err := Templates.ExecuteTemplate(w, "dashboard", s.Prefix); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Error rendering template"))
 		log.Println(r.RemoteAddr, r.RequestURI, http.StatusInternalServerError, "Error rendering template")
@@ -32,14 +64,34 @@ func (s *Server) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := ioutil.ReadFile("odms/" + fname + ".log")
-	if err != nil {
+	job, ok := s.jobs.Get(fname)
+	if !ok || !requestUser(r).CanSee(job) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such job"))
+		return
+	}
+	// Browsers get the live status page, anything else the plain log
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		data := struct{ Prefix, Id string }{s.Prefix, job.Id}
+		if err := Templates.ExecuteTemplate(w, "status", data); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error rendering template"))
+			log.Println(r.RemoteAddr, r.RequestURI, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	b, err := ioutil.ReadFile(s.jobs.LogFile(job))
+	if err != nil && !os.IsNotExist(err) {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(err.Error()))
 		log.Println(r.RemoteAddr, r.RequestURI, http.StatusInternalServerError, err)
 		return
 	}
 
+	fmt.Fprintf(w, "State: %s\n", job.State)
+	if job.Error != "" {
+		fmt.Fprintf(w, "Error: %s\n", job.Error)
+	}
 	w.Write(b)
 }
 
@@ -48,7 +100,7 @@ func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	file, header, err := r.FormFile("odmFile")
+	results, err := s.addUploads(w, r)
 	if err != nil {
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte(err.Error()))
@@ -56,82 +108,205 @@ func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start to download the file
-	if header.Size > 9999 {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("file size exceeds limits"))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, "file size exceeds limits", header.Filename, header.Size)
+	// Many files go to the dashboard, a single one to its status
+	if len(results) > 1 {
+		http.Redirect(w, r, s.Prefix+"/jobs", http.StatusSeeOther)
 		return
 	}
-
-	if !strings.HasSuffix(header.Filename, ".odm") {
+	if results[0].Job == nil {
 		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("file type not accepted"))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, "file type not accepted", header.Filename)
+		w.Write([]byte(results[0].Error))
 		return
 	}
+	http.Redirect(w, r, s.Prefix+"/status?id="+results[0].Job.Id, http.StatusTemporaryRedirect)
+}
 
-	// Split the filepath just to be safe
-	_, fname := filepath.Split(header.Filename)
-	outfile := filepath.Join("odms", fname)
+// Extension of the files accepted for upload
+const odmExt = ".odm"
 
-	// Check if we have already downloaded this book
-	if i, err := os.Stat(outfile + ".log"); err == nil && i.Size() > 0 {
-		http.Redirect(w, r, s.Prefix+"/status?id="+fname, http.StatusTemporaryRedirect)
-		return
+// Most ODM files accepted in one upload
+const maxUploadFiles = 100
+
+// Outcomes of an uploaded file
+const (
+	UploadAccepted  = "accepted"
+	UploadDuplicate = "duplicate"
+	UploadInvalid   = "invalid"
+	UploadError     = "error" // The file was fine but the server could not queue it
+)
+
+// UploadResult is what happened to one file of an upload
+type UploadResult struct {
+	File   string  `json:"file"`
+	Result string  `json:"result"`
+	Error  string  `json:"error,omitempty"`
+	Job    *apiJob `json:"job,omitempty"`
+}
+
+var (
+	ErrDuplicateJob = errors.New("book has already been submitted")
+	ErrInLibrary    = errors.New("book is already in the library")
+)
+
+// What to do when a book is uploaded again
+const (
+	DuplicateResume     = "resume"     // Download with the new ODM, keeping the parts already there
+	DuplicateRedownload = "redownload" // Download every part again with the new ODM
+	DuplicateLink       = "link"       // Do not download, point the upload at the existing book
+)
+
+// InvalidODMError is an uploaded file that is not an ODM we can download
+type InvalidODMError string
+
+func (e InvalidODMError) Error() string {
+	return string(e)
+}
+
+// Queue every odmFile of a multipart upload, a bad file does not stop the others
+func (s *Server) addUploads(w http.ResponseWriter, r *http.Request) ([]UploadResult, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*(s.maxUploadSize+1024))
+	if err := r.ParseMultipartForm(maxUploadFiles * (s.maxUploadSize + 1024)); err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+	headers := r.MultipartForm.File["odmFile"]
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("no odmFile uploaded")
+	}
+	if len(headers) > maxUploadFiles {
+		return nil, fmt.Errorf("at most %d files may be uploaded at once", maxUploadFiles)
+	}
+
+	results := make([]UploadResult, 0, len(headers))
+	for _, header := range headers {
+		result := UploadResult{File: header.Filename}
+		job, err := s.addUpload(header, requestUser(r), r.FormValue("duplicate"))
+		_, invalid := err.(InvalidODMError)
+		switch {
+		case err == nil:
+			result.Result = UploadAccepted
+		case err == ErrDuplicateJob || err == ErrInLibrary:
+			result.Result = UploadDuplicate
+		case invalid:
+			result.Result = UploadInvalid
+		default:
+			result.Result = UploadError
+		}
+		if err != nil {
+			result.Error = err.Error()
+			log.Println(r.RemoteAddr, r.RequestURI, header.Filename, result.Result, err)
+		}
+		if job.Id != "" {
+			aj := newApiJob(job)
+			result.Job = &aj
+		}
+		results = append(results, result)
 	}
-	f, err := os.Create(outfile)
+	return results, nil
+}
+
+func (s *Server) addUpload(header *multipart.FileHeader, u *User, choice string) (Job, error) {
+	file, err := header.Open()
 	if err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte(err.Error()))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, err)
-		return
+		return Job{}, err
 	}
-	defer f.Close()
-	// Write to the outfile, the in memory buffer, and the hasher all at once
-	b := new(bytes.Buffer)
-	if _, err := io.Copy(io.MultiWriter(f, b), file); err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte(err.Error()))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, err)
-		return
+	defer file.Close()
+	return s.addODM(header.Filename, file, u, choice)
+}
+
+/*
+Check an uploaded ODM file, save it and queue a job for it. When the user already has the book,
+as a job or in the library, choice says what to do. Without a choice the existing job is
+returned with ErrDuplicateJob, or ErrInLibrary if there is only the book
+*/
+func (s *Server) addODM(filename string, r io.Reader, u *User, choice string) (Job, error) {
+	if !strings.HasSuffix(filename, odmExt) {
+		return Job{}, InvalidODMError("file type not accepted")
 	}
-	odm := &OverDriveMedia{}
-	err = xml.Unmarshal([]byte(b.Bytes()), &odm)
+	switch choice {
+	case "", DuplicateResume, DuplicateRedownload, DuplicateLink:
+	default:
+		return Job{}, fmt.Errorf("unknown duplicate choice %q, expected resume, redownload or link", choice)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, s.maxUploadSize+1))
 	if err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte(err.Error()))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, "invalid ODM file:", err)
-		return
+		return Job{}, err
+	}
+	if int64(len(data)) > s.maxUploadSize {
+		return Job{}, InvalidODMError("file size exceeds limits")
+	}
+
+	odm := &OverDriveMedia{}
+	if err := xml.Unmarshal(data, &odm); err != nil {
+		return Job{}, InvalidODMError(fmt.Sprintf("invalid ODM file: %s", err))
 	}
 	if odm.Id == "" || odm.License.AcquisitionUrl == "" {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte(err.Error()))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, "invalid ODM file")
-		return
+		return Job{}, InvalidODMError("invalid ODM file")
 	}
 
-	odm.filename = outfile
-	lf, err := os.Create(odm.filename + ".log")
-	if err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte(err.Error()))
-		log.Println(r.RemoteAddr, r.RequestURI, http.StatusNotAcceptable, err)
-		return
+	// The name is only shown, never used as a path
+	job := &Job{
+		Owner:   u.owner(),
+		Name:    filepath.Base(filename),
+		MediaId: odm.Id,
+		Expires: odm.DrmInfo.ExpirationDate,
+	}
+	if md, err := odm.GetMetadata(); err == nil {
+		job.Title, job.Author = md.Title, md.GetAuthor()
 	}
-	lf.Close()
-	go s.DownloadForWeb(odm)
 
-	http.Redirect(w, r, s.Prefix+"/status?id="+fname, http.StatusTemporaryRedirect)
-}
+	existing, hasJob := s.jobs.FindMedia(odm.Id, job.Owner)
+	inLibrary := ""
+	if !hasJob {
+		inLibrary = FindInLibrary(s.userOutdir(job.Owner), odm.Id)
+	}
+	if choice == "" && hasJob {
+		return existing, ErrDuplicateJob
+	}
+	if choice == "" && inLibrary != "" {
+		return Job{}, ErrInLibrary
+	}
 
-/* Download the ODM file, logging output and threading the file */
-func (s *Server) DownloadForWeb(o *OverDriveMedia) {
-	// Logfile
+	// The same file uploaded again is stored once
+	sum := sha256.Sum256(data)
+	if job.Odm, err = safeJoin(s.DataDir, hex.EncodeToString(sum[:])+odmExt); err != nil {
+		return Job{}, err
+	}
+	if _, err := os.Stat(job.Odm); err != nil {
+		if err := ioutil.WriteFile(job.Odm, data, 0644); err != nil {
+			return Job{}, err
+		}
+	}
 
+	switch {
+	case hasJob && choice == DuplicateLink:
+		job.LinkedTo = existing.Id
+		job.Outdir = existing.Outdir
+		err = s.jobs.AddDone(job)
+	case hasJob:
+		if err := s.jobs.Requeue(existing.Id, job.Odm, choice == DuplicateRedownload); err != nil {
+			return Job{}, err
+		}
+		job.Id = existing.Id
+	case inLibrary != "" && choice == DuplicateLink:
+		job.Outdir = inLibrary
+		err = s.jobs.AddDone(job)
+	default:
+		job.Redownload = choice == DuplicateRedownload
+		err = s.jobs.Add(job)
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	added, _ := s.jobs.Get(job.Id)
+	return added, nil
+}
+
+/* Download the book of the job, logging output and threading the file */
+func (s *Server) DownloadForWeb(ctx context.Context, j *Job) error {
 	logChan := make(chan string)
 	wg2 := &sync.WaitGroup{}
-	go func(wg *sync.WaitGroup, logs chan string, filename string) {
+	go func(wg *sync.WaitGroup, logs chan string, filename string, events *EventBus) {
 		defer wg.Done()
 		logf, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
@@ -145,137 +320,271 @@ func (s *Server) DownloadForWeb(o *OverDriveMedia) {
 				fmt.Println("FATAL:", err, n)
 			}
 			fmt.Printf("%+v %s\n", time.Now(), l)
+			events.Publish(logEvent(j.Id, l))
 		}
-	}(wg2, logChan, o.filename+".log")
+	}(wg2, logChan, s.jobs.LogFile(*j), s.events)
 	wg2.Add(1)
 
-	md, _ := o.GetMetadata()
+	err := s.downloadJob(ctx, j, logChan)
+	if err != nil {
+		logChan <- fmt.Sprintf("ERR: %s", err)
+	}
+	close(logChan)
+	wg2.Wait()
+	if err != nil {
+		return err
+	}
+
+	// Once splitting the job cannot be cancelled, check for a cancel that came just before
+	s.jobs.SetState(j, JobSplitting)
+	if ctx.Err() != nil {
+		return ErrJobCancelled
+	}
+	logf, err := os.OpenFile(s.jobs.LogFile(*j), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open logfile: %s", err)
+	}
+	defer logf.Close()
+	parser := ParseChapters{
+		logfile:   io.MultiWriter(logf, &eventWriter{s.events, j.Id}),
+		Directory: j.Outdir,
+		Odm:       j.Odm,
+		ChapterOptions: ChapterOptions{
+			Originals: OriginalsZip, // Compress the originals
+			ZipLevel:  flate.DefaultCompression,
+		},
+	}
+	return parser.Run()
+}
+
+// Get the license, download and validate the parts and return the book
+func (s *Server) downloadJob(ctx context.Context, j *Job, logChan chan string) error {
+	o, err := NewODMFile(j.Odm)
+	if err != nil {
+		return err
+	}
+	md, err := o.GetMetadata()
+	if err != nil {
+		return err
+	}
+	// The title is one directory in the library, whatever the ODM says
+	outdir, err := safeJoin(s.userOutdir(j.Owner), bookDirName(md.Title, o.Id))
+	if err != nil {
+		return err
+	}
+	s.jobs.Update(j, func(j *Job) {
+		j.Title = md.Title
+		j.Author = md.GetAuthor()
+		j.Outdir = outdir
+		j.Expires = o.DrmInfo.ExpirationDate
+	})
 	logChan <- fmt.Sprintf("LOG: Starting download for %s", md.Title)
-	outdir := filepath.Join(s.Outdir, md.Title)
 	if err := os.MkdirAll(outdir, 0755); err != nil {
-		logChan <- fmt.Sprintf("ERR: Could not make directory: %s", err)
-		close(logChan)
-		wg2.Wait()
-		return
+		return fmt.Errorf("could not make directory: %s", err)
 	}
 
+	if err := o.SelectFormat(s.Format, s.Quality); err != nil {
+		return err
+	}
 	format := o.chooseBestFormat()
+	if err := format.checkPartNames(); err != nil {
+		return err
+	}
+	logChan <- fmt.Sprintf("LOG: Using format %s", format)
 	url := o.getDownloadUrl(format)
 	if url == "" {
-		logChan <- "ERR: could not get download url"
-		close(logChan)
-		wg2.Wait()
-		return
+		return fmt.Errorf("could not get download url")
 	}
+	s.jobs.SetState(j, JobLicensing)
 	if _, err := o.GetLicense(); err != nil {
-		logChan <- fmt.Sprintf("ERR: Could not get license: %s", err)
-		close(logChan)
-		wg2.Wait()
-		return
+		return fmt.Errorf("could not get license: %s", err)
 	}
 	logChan <- "LOG: Downloaded license file"
 
 	type d struct {
+		i       int
 		outfile string
 		p       Part
 	}
 
 	dataChan := make(chan d)
 
+	parts := make([]JobPart, len(format.Parts.Part))
+	for i, part := range format.Parts.Part {
+		parts[i] = JobPart{Number: part.Number, Name: part.Name, Size: int64(part.FileSize), State: PartPending}
+	}
+	s.jobs.Update(j, func(j *Job) {
+		j.State = JobDownloading
+		j.Parts = parts
+	})
+	// Progress goes to the job in memory, it is saved with the next state change
+	setPart := func(i int, state string, n int64) {
+		s.jobs.UpdateProgress(j, func(j *Job) {
+			j.Parts[i].State = state
+			j.Parts[i].Downloaded = n
+		})
+	}
+
 	wg := &sync.WaitGroup{}
-	for i := 0; i < 10; i++ {
+	// One worker waits out the quiet hours for the job, the others queue behind it
+	quiet := &sync.Mutex{}
+	o.SetLimiter(s.limiter)
+	for i := 0; i < s.ThreadsPerJob; i++ {
 		go func(wg *sync.WaitGroup, dataChan chan d, logChan chan string) {
 			defer wg.Done()
 			for data := range dataChan {
-				if err := o.DownloadPart(data.p, data.outfile); err != nil {
+				quiet.Lock()
+				if ctx.Err() == nil {
+					s.waitQuietHours(ctx, logChan)
+				}
+				quiet.Unlock()
+				if ctx.Err() != nil {
+					continue
+				}
+				i := data.i
+				setPart(i, PartDownloading, 0)
+				err := o.DownloadPartContext(ctx, data.p, data.outfile, func(n int64) {
+					setPart(i, PartDownloading, n)
+				})
+				if err != nil {
+					setPart(i, PartFailed, 0)
 					logChan <- fmt.Sprintf("ERR: Could not download part %s: %s", data.p.Number, err)
 					continue
 				}
+				setPart(i, PartDone, int64(data.p.FileSize))
 				logChan <- fmt.Sprintf("LOG: Saved part %s", data.p.Number)
 			}
 		}(wg, dataChan, logChan)
 		wg.Add(1)
 	}
 
-	for _, part := range o.chooseBestFormat().Parts.Part {
-		filenameParts := strings.Split(part.FileName, "-")
-		filename := filenameParts[len(filenameParts)-1]
-		filename = filepath.Join(outdir, filename)
-		if s, err := os.Stat(filename); err == nil {
+	// The job can be changed while it runs, read it under the lock
+	current, _ := s.jobs.Get(j.Id)
+	for i, part := range format.Parts.Part {
+		filename := filepath.Join(outdir, part.LocalName())
+		if s, err := os.Stat(filename); err == nil && !current.Redownload {
 			if s.Size() == int64(part.FileSize) {
+				setPart(i, PartDone, s.Size())
 				logChan <- fmt.Sprintf("LOG: Part %s already downloaded, skipping", part.Number)
 				continue
 			}
 		}
 		dataChan <- d{
+			i:       i,
 			outfile: filename,
 			p:       part,
 		}
 	}
-	albumArt := filepath.Join(outdir, "folder.jpg")
-	if i, err := os.Stat(albumArt); err == nil && i.Size() != 0 {
-		// Already have it
-	} else {
-		r, err := http.NewRequest("GET", md.CoverUrl, nil)
-		if err != nil {
-			logChan <- fmt.Sprintf("ERR: Could not download album art: %s", err)
-		}
-		c := &http.Client{}
-		resp, err := c.Do(r)
-		if err != nil {
-			logChan <- fmt.Sprintf("ERR: Could not download album art: %s", err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			b, _ := ioutil.ReadAll(resp.Body)
-			logChan <- fmt.Sprintf("ERR: Could not download album art: %s", string(b))
-		}
-		outf, err := os.Create(filepath.Join(outdir, "folder.jpg"))
-		if err != nil {
-			logChan <- fmt.Sprintf("ERR: Could not download album art: %s", err)
-		}
-		defer outf.Close()
-		io.Copy(outf, resp.Body)
-		logChan <- "Successfully Downloaded album Art"
-	}
 	close(dataChan)
 	wg.Wait()
+	if ctx.Err() != nil {
+		return ErrJobCancelled
+	}
+	// Whatever happened, the parts that were there have been downloaded again
+	s.jobs.Update(j, func(j *Job) { j.Redownload = false })
+
+	// Get the cover once the parts are here, they may have one embedded
+	if c, err := o.SaveCover(outdir, s.CoverFromParts); err != nil {
+		logChan <- fmt.Sprintf("ERR: Could not download album art: %s", err)
+	} else {
+		logChan <- fmt.Sprintf("Successfully Downloaded album Art: %s", c)
+	}
 
+	s.jobs.SetState(j, JobValidating)
 	count := 0
-	for _, p := range o.chooseBestFormat().Parts.Part {
-		filenameParts := strings.Split(p.FileName, "-")
-		filename := filenameParts[len(filenameParts)-1]
-		filename = filepath.Join(outdir, filename)
-		if s, err := os.Stat(filename); err == nil {
-			if s.Size() == int64(p.FileSize) {
-				count++
-			} else {
-				logChan <- fmt.Sprintf("ERR: Missing part %s", p.Number)
-			}
+	for _, p := range format.Parts.Part {
+		filename := filepath.Join(outdir, p.LocalName())
+		if s, err := os.Stat(filename); err == nil && s.Size() == int64(p.FileSize) {
+			count++
+		} else {
+			logChan <- fmt.Sprintf("ERR: Missing part %s", p.Number)
 		}
 	}
-	if count != len(o.chooseBestFormat().Parts.Part) {
-		logChan <- "ERR: Book validation failed. No returning. Please contact administrator"
-	} else {
-		logChan <- "Book successfully downloaded. Returning book."
+	if count != len(format.Parts.Part) {
+		return fmt.Errorf("book validation failed. No returning. Please contact administrator")
+	}
+	if err := WriteManifest(outdir, o.Id); err != nil {
+		logChan <- fmt.Sprintf("ERR: Could not write manifest: %s", err)
 	}
-	o.Return()
 
-	close(logChan)
-	wg2.Wait()
-	logf, err := os.OpenFile(o.filename+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if current, _ := s.jobs.Get(j.Id); current.Returned {
+		logChan <- "Book successfully downloaded, it was already returned."
+		return nil
+	}
+	s.jobs.SetState(j, JobReturning)
+	logChan <- "Book successfully downloaded. Returning book."
+	if err := o.Return(); err != nil {
+		// The book is already here, a failed return should not stop it being split
+		logChan <- fmt.Sprintf("ERR: Could not return book: %s", err)
+		return nil
+	}
+	s.jobs.Update(j, func(j *Job) { j.Returned = true })
+	return nil
+}
+
+// Books of each user go in their own directory
+func (s *Server) userOutdir(owner string) string {
+	return filepath.Join(s.Outdir, owner)
+}
+
+// Name of the directory of a book, the title made into one path element or else the ODM id
+func bookDirName(title, id string) string {
+	clean := strings.NewReplacer("/", "_", "\\", "_", "\x00", "")
+	for _, name := range []string{title, id} {
+		name = strings.TrimSpace(clean.Replace(name))
+		if name != "" && name != "." && name != ".." {
+			return name
+		}
+	}
+	return "book"
+}
+
+// Forget finished jobs older than the retention, checking every hour or sooner
+func (s *Server) pruneJobs() {
+	every := time.Hour
+	if s.Retention < every {
+		every = s.Retention
+	}
+	for {
+		if n := s.jobs.Prune(time.Now().Add(-s.Retention)); n > 0 {
+			log.Println("Removed", n, "jobs finished more than", s.Retention, "ago")
+		}
+		time.Sleep(every)
+	}
+}
+
+// Return the book of a job now, whatever state it is in
+func (s *Server) returnJob(id string) error {
+	job, ok := s.jobs.Get(id)
+	if !ok {
+		return ErrNoJob
+	}
+	if job.Returned {
+		return fmt.Errorf("book has already been returned")
+	}
+	o, err := NewODMFile(job.Odm)
 	if err != nil {
-		fmt.Println("Error opening logfile:", err)
-		return
+		return err
 	}
-	parser := ParseChapters{
-		logfile:   logf,
-		Directory: outdir,
-		Delete:    true, // Compress the originals
+	if err := o.Return(); err != nil {
+		return err
+	}
+	return s.jobs.Modify(id, func(j *Job) { j.Returned = true })
+}
+
+// Block while it is quiet hours, parts that are already downloading are allowed to finish
+func (s *Server) waitQuietHours(ctx context.Context, logChan chan string) {
+	wait := s.quiet.Remaining(time.Now())
+	if wait == 0 {
+		return
 	}
-	if err = parser.Run(); err != nil {
-		fmt.Println("Error parsing:", err)
+	logChan <- fmt.Sprintf("LOG: Quiet hours %s, pausing downloads for %s", s.quiet, wait.Round(time.Minute))
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
 		return
 	}
+	logChan <- "LOG: Quiet hours over, resuming downloads"
 }
 
 func logRequest(handler http.Handler) http.Handler {